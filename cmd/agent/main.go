@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dimakirio/calculatorv1/internal/agent"
+	"github.com/dimakirio/calculatorv1/pkg/config"
+	"github.com/dimakirio/calculatorv1/pkg/logger"
+)
+
+func main() {
+	cfg := config.LoadConfig()
+	log := logger.NewLogger(cfg.LogLevel)
+
+	if cfg.ComputingPower < 1 {
+		log.Fatal(fmt.Sprintf("COMPUTING_POWER must be positive, got %d", cfg.ComputingPower))
+	}
+	// Used until the orchestrator sends its own interval at registration
+	if cfg.AgentHeartbeatIntervalMS < 1 {
+		log.Fatal(fmt.Sprintf("AGENT_HEARTBEAT_INTERVAL_MS must be positive, got %d", cfg.AgentHeartbeatIntervalMS))
+	}
+
+	// Register with the orchestrator and start the workers in the background
+	a := agent.NewAgent(log, cfg)
+	a.Start()
+	log.Info(fmt.Sprintf("Agent started with %d workers, orchestrator %s", cfg.ComputingPower, cfg.OrchestratorURL))
+
+	// Blocking main and waiting for shutdown.
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	sig := <-shutdown
+
+	// Leased tasks are not returned explicitly: the orchestrator re-queues them
+	// once the agent misses its heartbeats.
+	log.Info(fmt.Sprintf("Agent is shutting down: %v", sig))
+}
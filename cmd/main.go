@@ -3,12 +3,16 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/dimakirio/calculatorv1/internal/auth"
+	"github.com/dimakirio/calculatorv1/internal/middleware"
+	"github.com/dimakirio/calculatorv1/internal/models"
 	"github.com/dimakirio/calculatorv1/internal/orchestrator"
 	"github.com/dimakirio/calculatorv1/pkg/config"
 	"github.com/dimakirio/calculatorv1/pkg/logger"
@@ -38,20 +42,61 @@ func main() {
 	cfg := config.LoadConfig()
 	log := logger.NewLogger(cfg.LogLevel)
 
-	orchestrator := orchestrator.NewOrchestrator(log, cfg)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(cfg, os.Args[2:]))
+	}
+
+	// Agents heartbeat at this interval; zero would have them spin and be reaped at once
+	if cfg.AgentHeartbeatIntervalMS < 1 {
+		log.Fatal(fmt.Sprintf("AGENT_HEARTBEAT_INTERVAL_MS must be positive, got %d", cfg.AgentHeartbeatIntervalMS))
+	}
+	// Agents are reaped after missing this many heartbeats; zero would reap them on registration
+	if cfg.AgentMissedHeartbeats < 1 {
+		log.Fatal(fmt.Sprintf("AGENT_MISSED_HEARTBEATS must be positive, got %d", cfg.AgentMissedHeartbeats))
+	}
+	// With a zero batch limit no task would be leased and every result rejected
+	if cfg.TaskBatchMax < 1 {
+		log.Fatal(fmt.Sprintf("TASK_BATCH_MAX must be positive, got %d", cfg.TaskBatchMax))
+	}
+
+	// One database handle shared by all requests; pending schema migrations are applied on open.
+	db, err := models.NewDatabase(cfg)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Failed to open database: %v", err))
+	}
+	defer db.Close()
+
+	orchestrator := orchestrator.NewOrchestrator(log, cfg, db)
+
+	// Expressions are private: these routes require a valid JWT
+	authMiddleware := middleware.AuthMiddleware(auth.NewJWTService(cfg.JWTSecret))
+	protected := func(next http.HandlerFunc) http.HandlerFunc {
+		return authMiddleware(next).ServeHTTP
+	}
 	
 	// Create a new mux and wrap handlers with middleware
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/v1/calculate", panicMiddleware(loggingMiddleware(orchestrator.HandleCalculate, log), log))
-	mux.HandleFunc("/api/v1/expressions", panicMiddleware(loggingMiddleware(orchestrator.HandleGetExpressions, log), log))
-	mux.HandleFunc("/api/v1/expressions/", panicMiddleware(loggingMiddleware(orchestrator.HandleGetExpressionByID, log), log))
+	mux.HandleFunc("/api/v1/calculate", panicMiddleware(loggingMiddleware(protected(orchestrator.HandleCalculate), log), log))
+	mux.HandleFunc("/api/v1/expressions", panicMiddleware(loggingMiddleware(protected(orchestrator.HandleGetExpressions), log), log))
+	mux.HandleFunc("/api/v1/expressions/", panicMiddleware(loggingMiddleware(protected(orchestrator.HandleExpression), log), log))
+	mux.HandleFunc("/api/v1/functions", panicMiddleware(loggingMiddleware(orchestrator.HandleGetFunctions, log), log))
 	mux.HandleFunc("/api/v1/register", panicMiddleware(loggingMiddleware(orchestrator.HandleRegister, log), log))
 	mux.HandleFunc("/api/v1/login", panicMiddleware(loggingMiddleware(orchestrator.HandleLogin, log), log))
+	mux.HandleFunc("/internal/task", panicMiddleware(loggingMiddleware(orchestrator.HandleInternalTask, log), log))
+	mux.HandleFunc("/internal/task/batch", panicMiddleware(loggingMiddleware(orchestrator.HandleInternalTaskBatch, log), log))
+	mux.HandleFunc("/internal/tasks", panicMiddleware(loggingMiddleware(protected(orchestrator.HandleGetTasks), log), log))
+	mux.HandleFunc("/internal/agents", panicMiddleware(loggingMiddleware(orchestrator.HandleRegisterAgent, log), log))
+	mux.HandleFunc("/internal/agents/", panicMiddleware(loggingMiddleware(orchestrator.HandleAgentHeartbeat, log), log))
+	mux.HandleFunc("/api/v1/agents", panicMiddleware(loggingMiddleware(protected(orchestrator.HandleGetAgents), log), log))
 
+	// Long-polling agents are released on shutdown instead of holding it up
+	pollCtx, stopPolls := context.WithCancel(context.Background())
 	server := &http.Server{
-		Addr:    ":" + cfg.ServerPort,
-		Handler: mux,
+		Addr:        ":" + cfg.ServerPort,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return pollCtx },
 	}
+	server.RegisterOnShutdown(stopPolls)
 
 	// Channel to listen for errors coming from the listener.
 	serverErrors := make(chan error, 1)
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dimakirio/calculatorv1/internal/models"
+	"github.com/dimakirio/calculatorv1/pkg/config"
+)
+
+const migrateUsage = `usage: main migrate [status|up]
+
+  status  show the schema version and which migrations are applied (default)
+  up      apply all pending migrations`
+
+// runMigrate implements the "migrate" subcommand and returns the process exit code.
+func runMigrate(cfg *config.Config, args []string) int {
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	if len(args) > 1 || (command != "status" && command != "up") {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	db, err := models.OpenDatabase(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	if command == "up" {
+		applied, err := db.Migrate()
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+	}
+
+	version, err := db.SchemaVersion()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read schema version: %v\n", err)
+		return 1
+	}
+	status, err := db.MigrationStatus()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read migrations: %v\n", err)
+		return 1
+	}
+	fmt.Printf("database: %s\nschema version: %d (latest %d)\n", cfg.DBPath, version, len(status))
+	for _, s := range status {
+		state := "pending"
+		if s.Applied {
+			state = "applied"
+		}
+		fmt.Printf("  %04d_%-24s %s\n", s.Version, s.Name, state)
+	}
+	if version > len(status) {
+		fmt.Fprintln(os.Stderr, (&models.SchemaTooNewError{Version: version, Latest: len(status)}).Error())
+		return 1
+	}
+	return 0
+}
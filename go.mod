@@ -3,7 +3,6 @@ module github.com/dimakirio/calculatorv1
 go 1.21
 
 require (
-	github.com/Knetic/govaluate v3.0.0+incompatible
 	github.com/golang-jwt/jwt/v5 v5.0.0
 	github.com/google/uuid v1.3.0
 	github.com/mattn/go-sqlite3 v1.14.17
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/dimakirio/calculatorv1/internal/models"
+)
+
+// startBatched запускает пакетный режим: один загрузчик берёт у оркестратора
+// столько задач, сколько воркеров свободно (но не больше AgentBatchSize), а
+// один отправитель сдаёт накопившиеся результаты одним запросом. Так число
+// запросов к оркестратору не растёт с числом воркеров.
+func (a *Agent) startBatched() {
+	// idle — по одному жетону на свободного воркера: загрузчик не берёт
+	// задач больше, чем их есть кому вычислять, и аренды не истекают в очереди.
+	idle := make(chan struct{}, a.cfg.ComputingPower)
+	tasks := make(chan *models.Task, a.cfg.ComputingPower)
+	results := make(chan models.TaskResult, a.cfg.ComputingPower)
+	for i := 0; i < a.cfg.ComputingPower; i++ {
+		idle <- struct{}{}
+		go func() {
+			for task := range tasks {
+				results <- a.compute(task)
+				idle <- struct{}{}
+			}
+		}()
+	}
+	go a.fetchBatches(idle, tasks)
+	go a.submitBatches(results)
+}
+
+// fetchBatches раздаёт воркерам задачи, полученные пакетами. Пустые ответы
+// и ошибки идут не чаще раза в AgentPollIntervalMS, как у одиночных воркеров.
+func (a *Agent) fetchBatches(idle chan struct{}, tasks chan<- *models.Task) {
+	interval := time.Duration(a.cfg.AgentPollIntervalMS) * time.Millisecond
+	for {
+		<-idle
+		free, size := 1, int(a.batchSize.Load())
+	collect:
+		for free < size {
+			select {
+			case <-idle:
+				free++
+			default:
+				break collect
+			}
+		}
+
+		start := time.Now()
+		batch := a.getTasks(free)
+		for _, task := range batch {
+			tasks <- task
+		}
+		for i := len(batch); i < free; i++ {
+			idle <- struct{}{}
+		}
+		if len(batch) == 0 {
+			time.Sleep(time.Until(start.Add(interval)))
+		}
+	}
+}
+
+// submitBatches отправляет результаты пакетами: всё, что накопилось, пока
+// отправлялся предыдущий пакет, но не больше batchSize за раз.
+func (a *Agent) submitBatches(results <-chan models.TaskResult) {
+	for res := range results {
+		batch, size := []models.TaskResult{res}, int(a.batchSize.Load())
+	drain:
+		for len(batch) < size {
+			select {
+			case res := <-results:
+				batch = append(batch, res)
+			default:
+				break drain
+			}
+		}
+		a.sendResults(batch)
+	}
+}
+
+// getTasks берёт у оркестратора до limit задач, ожидая их длинным опросом.
+func (a *Agent) getTasks(limit int) []*models.Task {
+	query := url.Values{
+		"agent_id": {a.id},
+		"max":      {strconv.Itoa(limit)},
+		"wait_ms":  {strconv.Itoa(a.cfg.AgentLongPollMS)},
+	}
+	resp, err := a.pollClient.Get(a.orchestratorURL + "/internal/task/batch?" + query.Encode())
+	if err != nil {
+		a.log.Error("Failed to get tasks: " + err.Error())
+		return nil
+	}
+	defer resp.Body.Close()
+
+	// 204 No Content означает, что готовых задач сейчас нет
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	var batch struct {
+		Tasks []*models.Task `json:"tasks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		a.log.Error("Failed to decode tasks: " + err.Error())
+		return nil
+	}
+	return batch.Tasks
+}
+
+// sendResults отправляет пакет результатов и возвращает ответ оркестратора
+// по каждому из них; отклонённые результаты пишутся в лог.
+func (a *Agent) sendResults(batch []models.TaskResult) []models.TaskAck {
+	jsonData, _ := json.Marshal(map[string][]models.TaskResult{"results": batch})
+	resp, err := a.client.Post(a.orchestratorURL+"/internal/task/batch", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		a.log.Error("Failed to send results: " + err.Error())
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		a.log.Error("Failed to send results, status code: " + resp.Status)
+		return nil
+	}
+	var acks struct {
+		Results []models.TaskAck `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&acks); err != nil {
+		a.log.Error("Failed to decode result acknowledgements: " + err.Error())
+		return nil
+	}
+	for _, ack := range acks.Results {
+		if ack.Status != http.StatusOK {
+			a.log.Error("Result of task " + ack.ID + " rejected, status code " + strconv.Itoa(ack.Status) + ": " + ack.Error)
+		}
+	}
+	return acks.Results
+}
@@ -4,47 +4,187 @@ import (
 	"bytes"
 	"encoding/json"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/dimakirio/calculatorv1/internal/calc"
 	"github.com/dimakirio/calculatorv1/internal/models"
 	"github.com/dimakirio/calculatorv1/pkg/config"
 	"github.com/dimakirio/calculatorv1/pkg/logger"
+	"github.com/google/uuid"
 )
 
 type Agent struct {
 	log *logger.Logger
 	cfg *config.Config
+	// orchestratorURL — адрес оркестратора, у которого агент берёт задачи.
+	orchestratorURL string
+	client          *http.Client
+	// pollClient ждёт ответа на длинный опрос дольше обычных запросов.
+	pollClient *http.Client
+
+	// id выбирается заново при каждом запуске агента, hostname — для
+	// администратора, чтобы найти машину агента.
+	id       string
+	hostname string
+	// heartbeatInterval задаёт оркестратор при регистрации.
+	heartbeatInterval time.Duration
+	// batchSize — AgentBatchSize, урезанный до TASK_BATCH_MAX оркестратора:
+	// больший пакет результатов оркестратор отклонил бы. Меняется при
+	// повторной регистрации, поэтому атомарный.
+	batchSize atomic.Int64
 }
 
 func NewAgent(log *logger.Logger, cfg *config.Config) *Agent {
-	return &Agent{log: log, cfg: cfg}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	a := &Agent{
+		log:               log,
+		cfg:               cfg,
+		orchestratorURL:   cfg.OrchestratorURL,
+		client:            &http.Client{Timeout: time.Duration(cfg.AgentRequestTimeoutMS) * time.Millisecond},
+		pollClient:        &http.Client{Timeout: time.Duration(cfg.AgentLongPollMS+cfg.AgentRequestTimeoutMS) * time.Millisecond},
+		id:                uuid.New().String(),
+		hostname:          hostname,
+		heartbeatInterval: time.Duration(cfg.AgentHeartbeatIntervalMS) * time.Millisecond,
+	}
+	a.batchSize.Store(int64(cfg.AgentBatchSize))
+	return a
 }
 
+// Start регистрирует агента и запускает воркеров. При AgentBatchSize больше
+// единицы задачи берутся и сдаются пакетами (см. startBatched).
 func (a *Agent) Start() {
+	a.register()
+	go a.heartbeat()
+	if a.cfg.AgentBatchSize > 1 {
+		a.startBatched()
+		return
+	}
 	for i := 0; i < a.cfg.ComputingPower; i++ {
 		go a.worker()
 	}
 }
 
+// register сообщает оркестратору ID агента, имя хоста и число воркеров.
+func (a *Agent) register() {
+	jsonData, _ := json.Marshal(map[string]interface{}{
+		"id":       a.id,
+		"hostname": a.hostname,
+		"workers":  a.cfg.ComputingPower,
+	})
+	resp, err := a.client.Post(a.orchestratorURL+"/internal/agents", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		a.log.Error("Failed to register agent: " + err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		a.log.Error("Failed to register agent, status code: " + resp.Status)
+		return
+	}
+	var registered struct {
+		HeartbeatIntervalMS int `json:"heartbeat_interval_ms"`
+		TaskBatchMax        int `json:"task_batch_max"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&registered); err == nil {
+		if registered.HeartbeatIntervalMS > 0 {
+			a.heartbeatInterval = time.Duration(registered.HeartbeatIntervalMS) * time.Millisecond
+		}
+		if registered.TaskBatchMax > 0 {
+			a.batchSize.Store(int64(min(a.cfg.AgentBatchSize, registered.TaskBatchMax)))
+		}
+	}
+	a.log.Info("Agent " + a.id + " registered with " + strconv.Itoa(a.cfg.ComputingPower) + " workers")
+}
+
+// heartbeat периодически сообщает оркестратору, что агент жив. Если
+// оркестратор агента не знает (например, он перезапустился), агент
+// регистрируется заново.
+func (a *Agent) heartbeat() {
+	for {
+		time.Sleep(a.heartbeatInterval)
+		if !a.sendHeartbeat() {
+			a.register()
+		}
+	}
+}
+
+// sendHeartbeat возвращает false, если оркестратор не знает агента.
+func (a *Agent) sendHeartbeat() bool {
+	resp, err := a.client.Post(a.orchestratorURL+"/internal/agents/"+url.PathEscape(a.id)+"/heartbeat", "application/json", nil)
+	if err != nil {
+		a.log.Error("Failed to send heartbeat: " + err.Error())
+		return true
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false
+	}
+	if resp.StatusCode != http.StatusOK {
+		a.log.Error("Failed to send heartbeat, status code: " + resp.Status)
+	}
+	return true
+}
+
+// worker вычисляет задачи одну за другой. Задачу агент ждёт длинным опросом:
+// оркестратор отвечает, как только задача появится. Пустые ответы и ошибки
+// идут не чаще раза в AgentPollIntervalMS, чтобы не забрасывать оркестратор
+// запросами, когда длинный опрос выключен или оркестратор недоступен.
 func (a *Agent) worker() {
+	interval := time.Duration(a.cfg.AgentPollIntervalMS) * time.Millisecond
 	for {
+		start := time.Now()
 		task := a.getTask()
-		if task != nil {
-			result := a.calculate(task)
-			a.sendResult(task.ID, result)
+		if task == nil {
+			time.Sleep(time.Until(start.Add(interval)))
+			continue
 		}
-		time.Sleep(time.Second)
+		a.process(task)
+	}
+}
+
+// process вычисляет задачу и отправляет результат.
+func (a *Agent) process(task *models.Task) {
+	a.sendResult(a.compute(task))
+}
+
+// compute вычисляет задачу и возвращает результат или ошибку вычисления в
+// том виде, в котором их принимает оркестратор. Перед вычислением агент
+// выдерживает заданное оркестратором время операции, имитируя дорогие вычисления.
+func (a *Agent) compute(task *models.Task) models.TaskResult {
+	time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
+	result, value, err := a.calculate(task)
+
+	res := models.TaskResult{ID: task.ID, LeaseID: task.LeaseID}
+	switch {
+	case err != nil:
+		res.Error = calc.TaskError(err)
+	case value != "":
+		res.Value = value
+	default:
+		res.Result = &result
 	}
+	return res
 }
 
 func (a *Agent) getTask() *models.Task {
-	resp, err := http.Get("http://localhost:8080/internal/task")
+	query := url.Values{"agent_id": {a.id}, "wait_ms": {strconv.Itoa(a.cfg.AgentLongPollMS)}}
+	resp, err := a.pollClient.Get(a.orchestratorURL + "/internal/task?" + query.Encode())
 	if err != nil {
 		a.log.Error("Failed to get task: " + err.Error())
 		return nil
 	}
 	defer resp.Body.Close()
 
+	// 204 No Content означает, что готовых задач сейчас нет
 	if resp.StatusCode != http.StatusOK {
 		return nil
 	}
@@ -58,30 +198,29 @@ func (a *Agent) getTask() *models.Task {
 	return &task
 }
 
-func (a *Agent) calculate(task *models.Task) float64 {
-	// Логика вычисления задачи
-	switch task.Operation {
-	case "+":
-		return task.Arg1 + task.Arg2
-	case "-":
-		return task.Arg1 - task.Arg2
-	case "*":
-		return task.Arg1 * task.Arg2
-	case "/":
-		return task.Arg1 / task.Arg2
-	default:
-		return 0
+// calculate выполняет операцию или функцию задачи; неизвестная операция и
+// аргумент вне области определения — это ошибка задачи, а не нулевой результат.
+//
+// Задачи точного и десятичного режимов вычисляются над дробями, результат —
+// строка value.
+func (a *Agent) calculate(task *models.Task) (float64, string, error) {
+	switch task.Mode {
+	case models.ModeExact:
+		value, err := calc.ExecuteExact(task)
+		return 0, value, err
+	case models.ModeDecimal:
+		value, err := calc.ExecuteDecimal(task)
+		return 0, value, err
 	}
+	result, err := calc.Execute(task)
+	return result, "", err
 }
 
-func (a *Agent) sendResult(taskID string, result float64) {
-	data := map[string]interface{}{
-		"id":     taskID,
-		"result": result,
-	}
-	jsonData, _ := json.Marshal(data)
+// sendResult отправляет оркестратору результат задачи или ошибку её вычисления.
+func (a *Agent) sendResult(res models.TaskResult) {
+	jsonData, _ := json.Marshal(res)
 
-	resp, err := http.Post("http://localhost:8080/internal/task", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := a.client.Post(a.orchestratorURL+"/internal/task", "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		a.log.Error("Failed to send result: " + err.Error())
 		return
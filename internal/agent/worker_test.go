@@ -0,0 +1,289 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dimakirio/calculatorv1/internal/auth"
+	"github.com/dimakirio/calculatorv1/internal/calc"
+	"github.com/dimakirio/calculatorv1/internal/middleware"
+	"github.com/dimakirio/calculatorv1/internal/models"
+	"github.com/dimakirio/calculatorv1/internal/orchestrator"
+	"github.com/dimakirio/calculatorv1/pkg/config"
+	"github.com/dimakirio/calculatorv1/pkg/logger"
+)
+
+// testConfig возвращает настройки с базой во временном каталоге теста.
+func testConfig(t *testing.T) *config.Config {
+	cfg := config.LoadConfig()
+	cfg.DBPath = filepath.Join(t.TempDir(), "calc.db")
+	return cfg
+}
+
+// newTestOrchestrator запускает оркестратор над новой базой и агента, который
+// обращается к нему через тестовый сервер с маршрутами из mux. База и сервер
+// закрываются в конце теста.
+func newTestOrchestrator(t *testing.T, cfg *config.Config, mux func(*orchestrator.Orchestrator) http.Handler) (*orchestrator.Orchestrator, *models.Database, *Agent) {
+	log := logger.NewLogger(cfg.LogLevel)
+	db, err := models.NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	o := orchestrator.NewOrchestrator(log, cfg, db)
+
+	srv := httptest.NewServer(mux(o))
+	t.Cleanup(srv.Close)
+	a := NewAgent(log, cfg)
+	a.orchestratorURL = srv.URL
+	return o, db, a
+}
+
+// calculate отправляет выражение от имени пользователя 1 и возвращает его ID.
+func calculate(t *testing.T, o *orchestrator.Orchestrator, body string) string {
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(body))
+	o.HandleCalculate(rr, req.WithContext(middleware.WithUser(req.Context(), middleware.User{ID: 1})))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var created map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	return created["id"]
+}
+
+func TestAgentRoundTrip(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AgentLongPollMS = 50 // пустой опрос в конце теста не должен его задерживать
+	jwtService := auth.NewJWTService(cfg.JWTSecret)
+	_, _, a := newTestOrchestrator(t, cfg, func(o *orchestrator.Orchestrator) http.Handler {
+		protected := middleware.AuthMiddleware(jwtService)
+		mux := http.NewServeMux()
+		mux.Handle("/api/v1/calculate", protected(http.HandlerFunc(o.HandleCalculate)))
+		mux.Handle("/api/v1/expressions/", protected(http.HandlerFunc(o.HandleGetExpressionByID)))
+		mux.HandleFunc("/internal/task", o.HandleInternalTask)
+		return mux
+	})
+
+	token, err := jwtService.GenerateToken(1, "agent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized := func(method, url string, body io.Reader) *http.Response {
+		req, err := http.NewRequest(method, url, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := authorized("POST", a.orchestratorURL+"/api/v1/calculate", bytes.NewBufferString(`{"expression": "(1 + 2) * (7 - 3) - 8 / 4 + 2 ^ 3 ^ 0 % 5 - 7 // 2 + sqrt(max(1, 16))"}`))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	var created map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Агент забирает задачи, пока оркестратор не ответит 204
+	for {
+		task := a.getTask()
+		if task == nil {
+			break
+		}
+		if task.LeaseID == "" {
+			t.Fatalf("task %s has no lease", task.ID)
+		}
+		a.process(task)
+	}
+
+	resp = authorized("GET", a.orchestratorURL+"/api/v1/expressions/"+created["id"], nil)
+	defer resp.Body.Close()
+	var got map[string]models.Expression
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if expr := got["expression"]; expr.Status != "completed" || expr.Result != 13 {
+		t.Errorf("expected completed expression with result 13, got %+v", expr)
+	}
+}
+
+func TestCalculateUnknownOperation(t *testing.T) {
+	cfg := config.LoadConfig()
+	a := NewAgent(logger.NewLogger(cfg.LogLevel), cfg)
+
+	if _, _, err := a.calculate(&models.Task{Operation: "?", Arg1: 1, Arg2: 2}); err == nil {
+		t.Error("expected error for unknown operation")
+	}
+	if _, _, err := a.calculate(&models.Task{Operation: "sqrt", Args: []float64{-1}}); err == nil {
+		t.Error("expected domain error for sqrt(-1)")
+	}
+	if _, _, err := a.calculate(&models.Task{Operation: models.OpDivide, Arg1: 1, Arg2: 0}); calc.TaskError(err).Code != models.ErrCodeDivisionByZero {
+		t.Errorf("expected division_by_zero, got %v", err)
+	}
+	if result, _, err := a.calculate(&models.Task{Operation: "max", Args: []float64{1, 5, 3}}); err != nil || result != 5 {
+		t.Errorf("expected 5, got %v (%v)", result, err)
+	}
+	if result, _, err := a.calculate(&models.Task{Operation: models.OpFloorDivide, Arg1: 7, Arg2: 2}); err != nil || result != 3 {
+		t.Errorf("expected 3, got %v (%v)", result, err)
+	}
+}
+
+func TestCalculateExact(t *testing.T) {
+	cfg := config.LoadConfig()
+	a := NewAgent(logger.NewLogger(cfg.LogLevel), cfg)
+
+	_, value, err := a.calculate(&models.Task{Mode: models.ModeExact, Operation: models.OpAdd, Values: []string{"1/3", "1/6"}})
+	if err != nil || value != "1/2" {
+		t.Errorf("expected 1/2, got %q (%v)", value, err)
+	}
+	if _, _, err := a.calculate(&models.Task{Mode: models.ModeExact, Operation: models.OpPower, Values: []string{"2", "1/2"}}); err == nil {
+		t.Error("expected error for non-integer exponent in exact mode")
+	}
+	if _, _, err := a.calculate(&models.Task{Mode: models.ModeExact, Operation: models.OpDivide, Values: []string{"1", "0"}}); err == nil {
+		t.Error("expected error for division by zero in exact mode")
+	}
+}
+
+func TestCalculateDecimal(t *testing.T) {
+	cfg := config.LoadConfig()
+	a := NewAgent(logger.NewLogger(cfg.LogLevel), cfg)
+
+	task := &models.Task{Mode: models.ModeDecimal, Operation: models.OpDivide, Values: []string{"1", "8"}, Scale: 2, Rounding: models.RoundHalfEven}
+	if _, value, err := a.calculate(task); err != nil || value != "0.12" {
+		t.Errorf("expected 0.12, got %q (%v)", value, err)
+	}
+	task.Rounding = models.RoundHalfUp
+	if _, value, err := a.calculate(task); err != nil || value != "0.13" {
+		t.Errorf("expected 0.13, got %q (%v)", value, err)
+	}
+}
+
+func TestOperationTime(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.TimeMultiplicationsMS = 50
+	o, _, a := newTestOrchestrator(t, cfg, func(o *orchestrator.Orchestrator) http.Handler {
+		return http.HandlerFunc(o.HandleInternalTask)
+	})
+	calculate(t, o, `{"expression": "6 * 7"}`)
+
+	task := a.getTask()
+	if task == nil || task.OperationTime != 50 {
+		t.Fatalf("expected task with operation_time 50, got %+v", task)
+	}
+
+	start := time.Now()
+	a.process(task)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("agent did not honor operation time: took %v", elapsed)
+	}
+}
+
+func TestAgentRegistration(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AdminLogins = []string{"admin"}
+	cfg.AgentBatchSize = 8
+	cfg.TaskBatchMax = 4
+	jwtService := auth.NewJWTService(cfg.JWTSecret)
+	_, _, a := newTestOrchestrator(t, cfg, func(o *orchestrator.Orchestrator) http.Handler {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/internal/agents", o.HandleRegisterAgent)
+		mux.HandleFunc("/internal/agents/", o.HandleAgentHeartbeat)
+		mux.Handle("/api/v1/agents", middleware.AuthMiddleware(jwtService)(http.HandlerFunc(o.HandleGetAgents)))
+		return mux
+	})
+
+	// Незарегистрированного агента оркестратор не знает
+	if a.sendHeartbeat() {
+		t.Fatal("expected heartbeat of an unregistered agent to be rejected")
+	}
+	a.register()
+	if !a.sendHeartbeat() {
+		t.Fatal("expected heartbeat of a registered agent to be accepted")
+	}
+	// Пакет агента урезается до ограничения оркестратора
+	if size := a.batchSize.Load(); size != int64(cfg.TaskBatchMax) {
+		t.Errorf("expected batch size %d, got %d", cfg.TaskBatchMax, size)
+	}
+
+	token, err := jwtService.GenerateToken(1, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", a.orchestratorURL+"/api/v1/agents", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got map[string][]models.Agent
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	agents := got["agents"]
+	if len(agents) != 1 || agents[0].ID != a.id || agents[0].Hostname != a.hostname || agents[0].Workers != cfg.ComputingPower || agents[0].Status != models.AgentAlive {
+		t.Errorf("expected the registered agent, got %+v", agents)
+	}
+}
+
+func TestAgentBatches(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AgentLongPollMS = 0
+	o, db, a := newTestOrchestrator(t, cfg, func(o *orchestrator.Orchestrator) http.Handler {
+		return http.HandlerFunc(o.HandleInternalTaskBatch)
+	})
+	id := calculate(t, o, `{"expression": "(1 + 2) * (3 + 4) - (5 + 6)"}`)
+
+	// Агент забирает готовые задачи пакетами, пока они не кончатся
+	rounds := 0
+	for {
+		batch := a.getTasks(10)
+		if len(batch) == 0 {
+			break
+		}
+		rounds++
+		results := make([]models.TaskResult, len(batch))
+		for i, task := range batch {
+			results[i] = a.compute(task)
+		}
+		// Результат по чужой аренде отклоняется, не мешая остальным
+		results = append(results, models.TaskResult{ID: batch[0].ID, LeaseID: "stale", Value: "1"})
+		acks := a.sendResults(results)
+		if len(acks) != len(results) {
+			t.Fatalf("expected %d acknowledgements, got %+v", len(results), acks)
+		}
+		for i, ack := range acks[:len(batch)] {
+			if ack.ID != batch[i].ID || ack.Status != http.StatusOK {
+				t.Errorf("expected result of %s to be accepted, got %+v", batch[i].ID, ack)
+			}
+		}
+		if last := acks[len(batch)]; last.Status != http.StatusNotFound && last.Status != http.StatusConflict {
+			t.Errorf("expected stale result to be rejected, got %+v", last)
+		}
+	}
+	// Три сложения, затем умножение, затем вычитание
+	if rounds != 3 {
+		t.Errorf("expected 3 batches, got %d", rounds)
+	}
+
+	expr, err := models.NewExpressionRepository(db.DB()).GetByID(id)
+	if err != nil || expr.Status != models.StatusCompleted || expr.Result != 10 {
+		t.Errorf("expected completed expression with result 10, got %+v (%v)", expr, err)
+	}
+}
@@ -0,0 +1,59 @@
+package calc
+
+import (
+	"math/big"
+	"strings"
+
+	"github.com/dimakirio/calculatorv1/internal/models"
+)
+
+// IsRoundingMode сообщает, поддерживается ли способ округления десятичного режима.
+func IsRoundingMode(mode string) bool {
+	switch mode {
+	case models.RoundHalfEven, models.RoundHalfUp, models.RoundDown:
+		return true
+	}
+	return false
+}
+
+// RoundDecimal округляет дробь до scale знаков после запятой указанным
+// способом и возвращает десятичную запись ровно с scale знаками: "12.30".
+func RoundDecimal(x *big.Rat, scale int, rounding string) string {
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)
+	scaled := new(big.Rat).Mul(x, new(big.Rat).SetInt(pow))
+
+	// q — частное с отбрасыванием дробной части, rem — остаток того же знака.
+	q, rem := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+	if rem.Sign() != 0 && rounding != models.RoundDown {
+		// Сравниваем отброшенную часть с половиной: 2*|rem| против знаменателя.
+		twice := new(big.Int).Lsh(new(big.Int).Abs(rem), 1)
+		cmp := twice.Cmp(scaled.Denom())
+		if cmp > 0 || cmp == 0 && (rounding == models.RoundHalfUp || q.Bit(0) == 1) {
+			q.Add(q, big.NewInt(int64(scaled.Sign())))
+		}
+	}
+
+	digits := new(big.Int).Abs(q).String()
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	sign := ""
+	if q.Sign() < 0 {
+		sign = "-"
+	}
+	if scale == 0 {
+		return sign + digits
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+// ExecuteDecimal выполняет задачу десятичного режима: операция вычисляется
+// точно, затем результат округляется до task.Scale знаков способом task.Rounding.
+// Так агенты получают одинаковый результат независимо от платформы.
+func ExecuteDecimal(task *models.Task) (string, error) {
+	result, err := executeRat(task)
+	if err != nil {
+		return "", err
+	}
+	return RoundDecimal(result, task.Scale, task.Rounding), nil
+}
@@ -0,0 +1,67 @@
+package calc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/dimakirio/calculatorv1/internal/models"
+)
+
+// ErrDivisionByZero возвращается при делении, целочисленном делении и взятии
+// остатка по нулю. В точной арифметике это ещё и защита: big.Rat паникует
+// при делении на ноль.
+var ErrDivisionByZero = errors.New("division by zero")
+
+// UnknownOperationError возвращается для операции вне словаря models.Task.Operation.
+type UnknownOperationError struct {
+	Operation string
+}
+
+func (e *UnknownOperationError) Error() string {
+	return fmt.Sprintf("unknown operation %q", e.Operation)
+}
+
+// NonFiniteError — результат операции не помещается в float64 (±Inf) или не
+// определён (NaN). Такой результат нельзя ни передать дальше, ни закодировать в JSON.
+type NonFiniteError struct {
+	Operation string
+	Value     float64
+}
+
+func (e *NonFiniteError) Error() string {
+	return fmt.Sprintf("%s: result is not a finite number (%v)", e.Operation, e.Value)
+}
+
+// finite пропускает только конечный результат операции.
+func finite(op string, result float64) (float64, error) {
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, &NonFiniteError{Operation: op, Value: result}
+	}
+	return result, nil
+}
+
+// TaskError переводит ошибку вычисления в структурированную ошибку задачи,
+// которую агент отправляет оркестратору.
+func TaskError(err error) *models.TaskError {
+	var (
+		unknown   *UnknownOperationError
+		domain    *DomainError
+		arity     *ArityError
+		nonFinite *NonFiniteError
+	)
+	code := models.ErrCodeCalculation
+	switch {
+	case errors.Is(err, ErrDivisionByZero):
+		code = models.ErrCodeDivisionByZero
+	case errors.As(err, &nonFinite):
+		code = models.ErrCodeNonFinite
+	case errors.As(err, &domain):
+		code = models.ErrCodeDomain
+	case errors.As(err, &arity):
+		code = models.ErrCodeInvalidArguments
+	case errors.As(err, &unknown):
+		code = models.ErrCodeUnknownOperation
+	}
+	return &models.TaskError{Code: code, Message: err.Error()}
+}
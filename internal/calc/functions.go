@@ -0,0 +1,202 @@
+package calc
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Variadic — значение MaxArgs для функций с неограниченным числом аргументов.
+const Variadic = -1
+
+// Function описывает функцию из белого списка, доступную в выражениях.
+type Function struct {
+	Name        string `json:"name"`
+	MinArgs     int    `json:"min_args"`
+	MaxArgs     int    `json:"max_args"`
+	Description string `json:"description"`
+
+	call func(args []float64) (float64, error)
+}
+
+// DomainError — аргумент вне области определения функции (sqrt(-1), ln(0)).
+type DomainError struct {
+	Function string
+	Message  string
+}
+
+func (e *DomainError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Function, e.Message)
+}
+
+// ArityError — функция вызвана с неподходящим числом аргументов.
+type ArityError struct {
+	Function string
+	Got      int
+}
+
+func (e *ArityError) Error() string {
+	f := functions[e.Function]
+	return fmt.Sprintf("%s expects %s, got %d", e.Function, f.arity(), e.Got)
+}
+
+// arity описывает допустимое число аргументов для сообщений об ошибках.
+func (f *Function) arity() string {
+	plural := func(n int) string {
+		if n == 1 {
+			return "1 argument"
+		}
+		return fmt.Sprintf("%d arguments", n)
+	}
+	switch {
+	case f.MaxArgs == Variadic:
+		return "at least " + plural(f.MinArgs)
+	case f.MinArgs == f.MaxArgs:
+		return plural(f.MinArgs)
+	default:
+		return fmt.Sprintf("%d to %d arguments", f.MinArgs, f.MaxArgs)
+	}
+}
+
+// CheckArity проверяет, что функции можно передать n аргументов.
+func (f *Function) CheckArity(n int) error {
+	if n < f.MinArgs || (f.MaxArgs != Variadic && n > f.MaxArgs) {
+		return &ArityError{Function: f.Name, Got: n}
+	}
+	return nil
+}
+
+// unary оборачивает функцию одного аргумента с проверкой области определения.
+func unary(name string, fn func(float64) float64, domain func(float64) string) func([]float64) (float64, error) {
+	return func(args []float64) (float64, error) {
+		if domain != nil {
+			if msg := domain(args[0]); msg != "" {
+				return 0, &DomainError{Function: name, Message: msg}
+			}
+		}
+		return fn(args[0]), nil
+	}
+}
+
+func nonNegative(x float64) string {
+	if x < 0 {
+		return "argument must be non-negative"
+	}
+	return ""
+}
+
+func positive(x float64) string {
+	if x <= 0 {
+		return "argument must be positive"
+	}
+	return ""
+}
+
+func unitInterval(x float64) string {
+	if x < -1 || x > 1 {
+		return "argument must be in [-1, 1]"
+	}
+	return ""
+}
+
+var functions = map[string]*Function{
+	"abs":   {MinArgs: 1, MaxArgs: 1, Description: "absolute value", call: unary("abs", math.Abs, nil)},
+	"sqrt":  {MinArgs: 1, MaxArgs: 1, Description: "square root", call: unary("sqrt", math.Sqrt, nonNegative)},
+	"cbrt":  {MinArgs: 1, MaxArgs: 1, Description: "cube root", call: unary("cbrt", math.Cbrt, nil)},
+	"exp":   {MinArgs: 1, MaxArgs: 1, Description: "e raised to the power x", call: unary("exp", math.Exp, nil)},
+	"ln":    {MinArgs: 1, MaxArgs: 1, Description: "natural logarithm", call: unary("ln", math.Log, positive)},
+	"log2":  {MinArgs: 1, MaxArgs: 1, Description: "base-2 logarithm", call: unary("log2", math.Log2, positive)},
+	"log10": {MinArgs: 1, MaxArgs: 1, Description: "base-10 logarithm", call: unary("log10", math.Log10, positive)},
+	"log": {MinArgs: 1, MaxArgs: 2, Description: "logarithm of x to base b, log(x[, b]); base 10 by default", call: func(args []float64) (float64, error) {
+		if msg := positive(args[0]); msg != "" {
+			return 0, &DomainError{Function: "log", Message: msg}
+		}
+		if len(args) == 1 {
+			return math.Log10(args[0]), nil
+		}
+		if args[1] <= 0 || args[1] == 1 {
+			return 0, &DomainError{Function: "log", Message: "base must be positive and not equal to 1"}
+		}
+		return math.Log(args[0]) / math.Log(args[1]), nil
+	}},
+	"sin":   {MinArgs: 1, MaxArgs: 1, Description: "sine of x radians", call: unary("sin", math.Sin, nil)},
+	"cos":   {MinArgs: 1, MaxArgs: 1, Description: "cosine of x radians", call: unary("cos", math.Cos, nil)},
+	"tan":   {MinArgs: 1, MaxArgs: 1, Description: "tangent of x radians", call: unary("tan", math.Tan, nil)},
+	"asin":  {MinArgs: 1, MaxArgs: 1, Description: "arcsine in radians", call: unary("asin", math.Asin, unitInterval)},
+	"acos":  {MinArgs: 1, MaxArgs: 1, Description: "arccosine in radians", call: unary("acos", math.Acos, unitInterval)},
+	"atan":  {MinArgs: 1, MaxArgs: 1, Description: "arctangent in radians", call: unary("atan", math.Atan, nil)},
+	"floor": {MinArgs: 1, MaxArgs: 1, Description: "largest integer not greater than x", call: unary("floor", math.Floor, nil)},
+	"ceil":  {MinArgs: 1, MaxArgs: 1, Description: "smallest integer not less than x", call: unary("ceil", math.Ceil, nil)},
+	"trunc": {MinArgs: 1, MaxArgs: 1, Description: "integer part of x", call: unary("trunc", math.Trunc, nil)},
+	"round": {MinArgs: 1, MaxArgs: 2, Description: "x rounded half away from zero to n decimal places, round(x[, n])", call: func(args []float64) (float64, error) {
+		if len(args) == 1 {
+			return math.Round(args[0]), nil
+		}
+		if args[1] != math.Trunc(args[1]) {
+			return 0, &DomainError{Function: "round", Message: "number of decimal places must be an integer"}
+		}
+		x, scale := args[0], math.Pow(10, args[1])
+		switch {
+		case math.IsInf(scale, 1) || math.Abs(x)*scale >= 1<<52:
+			// В этом масштабе у x уже нет дробной части: round(1.5, 400) —
+			// это 1.5, а не Inf/Inf = NaN
+			return x, nil
+		case args[1] < -308:
+			// Любое конечное x меньше 10^309 / 2, а 10^n здесь уже ноль
+			return 0, nil
+		}
+		return math.Round(x*scale) / scale, nil
+	}},
+	"min": {MinArgs: 1, MaxArgs: Variadic, Description: "smallest of the arguments", call: func(args []float64) (float64, error) {
+		result := args[0]
+		for _, x := range args[1:] {
+			result = math.Min(result, x)
+		}
+		return result, nil
+	}},
+	"max": {MinArgs: 1, MaxArgs: Variadic, Description: "largest of the arguments", call: func(args []float64) (float64, error) {
+		result := args[0]
+		for _, x := range args[1:] {
+			result = math.Max(result, x)
+		}
+		return result, nil
+	}},
+}
+
+func init() {
+	for name, f := range functions {
+		f.Name = name
+	}
+}
+
+// LookupFunction возвращает функцию из белого списка по имени.
+func LookupFunction(name string) (*Function, bool) {
+	f, ok := functions[name]
+	return f, ok
+}
+
+// Functions возвращает все доступные функции, отсортированные по имени.
+func Functions() []Function {
+	list := make([]Function, 0, len(functions))
+	for _, f := range functions {
+		list = append(list, *f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Call вызывает функцию с проверкой числа аргументов и области определения.
+func Call(name string, args []float64) (float64, error) {
+	f, ok := functions[name]
+	if !ok {
+		return 0, &UnknownOperationError{Operation: name}
+	}
+	if err := f.CheckArity(len(args)); err != nil {
+		return 0, err
+	}
+	result, err := f.call(args)
+	if err != nil {
+		return 0, err
+	}
+	return finite(name, result)
+}
@@ -0,0 +1,52 @@
+// Package calc содержит арифметику, общую для оркестратора и агентов:
+// оркестратор вычисляет по ней выражения на месте, агенты — выданные задачи.
+package calc
+
+import (
+	"math"
+
+	"github.com/dimakirio/calculatorv1/internal/models"
+)
+
+// Apply выполняет бинарную операцию над двумя числами.
+//
+// Целочисленное деление и остаток согласованы между собой и округляют
+// частное вниз, как в Python: a == (a // b) * b + a % b, а знак остатка
+// совпадает со знаком делителя.
+func Apply(op string, a, b float64) (float64, error) {
+	var result float64
+	switch op {
+	case models.OpAdd:
+		result = a + b
+	case models.OpSubtract:
+		result = a - b
+	case models.OpMultiply:
+		result = a * b
+	case models.OpDivide, models.OpModulo, models.OpFloorDivide:
+		if b == 0 {
+			return 0, ErrDivisionByZero
+		}
+		switch op {
+		case models.OpDivide:
+			result = a / b
+		case models.OpModulo:
+			result = a - b*math.Floor(a/b)
+		default:
+			result = math.Floor(a / b)
+		}
+	case models.OpPower:
+		result = math.Pow(a, b)
+	default:
+		return 0, &UnknownOperationError{Operation: op}
+	}
+	return finite(op, result)
+}
+
+// Execute выполняет задачу: вызов функции над Args или бинарную операцию
+// над Arg1 и Arg2.
+func Execute(task *models.Task) (float64, error) {
+	if _, ok := functions[task.Operation]; ok {
+		return Call(task.Operation, task.Args)
+	}
+	return Apply(task.Operation, task.Arg1, task.Arg2)
+}
@@ -0,0 +1,217 @@
+package calc
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/dimakirio/calculatorv1/internal/models"
+)
+
+// exactFunctions — функции, результат которых рационален для рациональных аргументов.
+var exactFunctions = map[string]func(args []*big.Rat) (*big.Rat, error){
+	"abs": func(args []*big.Rat) (*big.Rat, error) {
+		return new(big.Rat).Abs(args[0]), nil
+	},
+	"floor": func(args []*big.Rat) (*big.Rat, error) {
+		return new(big.Rat).SetInt(floorRat(args[0])), nil
+	},
+	"ceil": func(args []*big.Rat) (*big.Rat, error) {
+		f := floorRat(new(big.Rat).Neg(args[0]))
+		return new(big.Rat).SetInt(f.Neg(f)), nil
+	},
+	"trunc": func(args []*big.Rat) (*big.Rat, error) {
+		return new(big.Rat).SetInt(new(big.Int).Quo(args[0].Num(), args[0].Denom())), nil
+	},
+	"round": func(args []*big.Rat) (*big.Rat, error) {
+		places := 0
+		if len(args) == 2 {
+			if !args[1].IsInt() || !args[1].Num().IsInt64() || args[1].Num().Int64() < 0 || args[1].Num().Int64() > maxExactDigits {
+				return nil, &DomainError{Function: "round", Message: fmt.Sprintf("number of decimal places must be an integer between 0 and %d", maxExactDigits)}
+			}
+			places = int(args[1].Num().Int64())
+		}
+		return ParseRat(RoundDecimal(args[0], places, models.RoundHalfUp))
+	},
+	"min": func(args []*big.Rat) (*big.Rat, error) {
+		result := args[0]
+		for _, x := range args[1:] {
+			if x.Cmp(result) < 0 {
+				result = x
+			}
+		}
+		return result, nil
+	},
+	"max": func(args []*big.Rat) (*big.Rat, error) {
+		result := args[0]
+		for _, x := range args[1:] {
+			if x.Cmp(result) > 0 {
+				result = x
+			}
+		}
+		return result, nil
+	},
+}
+
+// SupportsExact сообщает, можно ли вычислить функцию в точном режиме.
+func SupportsExact(name string) bool {
+	_, ok := exactFunctions[name]
+	return ok
+}
+
+// ParseRat разбирает дробь ("1/3"), десятичную ("0.1") или экспоненциальную
+// ("2.5e-3") запись числа без потери точности.
+func ParseRat(s string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("invalid rational number %q", s)
+	}
+	return r, nil
+}
+
+// floorRat округляет дробь вниз до целого.
+func floorRat(x *big.Rat) *big.Int {
+	// У big.Rat знаменатель всегда положителен, поэтому Euclid-деление
+	// числителя на него и есть округление вниз.
+	q, m := new(big.Int), new(big.Int)
+	q.DivMod(x.Num(), x.Denom(), m)
+	return q
+}
+
+// ApplyRat выполняет бинарную операцию над рациональными числами. Степень
+// допускает только целый показатель — иначе результат иррационален.
+func ApplyRat(op string, a, b *big.Rat) (*big.Rat, error) {
+	switch op {
+	case models.OpAdd:
+		return new(big.Rat).Add(a, b), nil
+	case models.OpSubtract:
+		return new(big.Rat).Sub(a, b), nil
+	case models.OpMultiply:
+		return new(big.Rat).Mul(a, b), nil
+	case models.OpDivide:
+		if b.Sign() == 0 {
+			return nil, ErrDivisionByZero
+		}
+		return new(big.Rat).Quo(a, b), nil
+	case models.OpFloorDivide:
+		if b.Sign() == 0 {
+			return nil, ErrDivisionByZero
+		}
+		return new(big.Rat).SetInt(floorRat(new(big.Rat).Quo(a, b))), nil
+	case models.OpModulo:
+		if b.Sign() == 0 {
+			return nil, ErrDivisionByZero
+		}
+		q := new(big.Rat).SetInt(floorRat(new(big.Rat).Quo(a, b)))
+		return new(big.Rat).Sub(a, q.Mul(q, b)), nil
+	case models.OpPower:
+		return powRat(a, b)
+	default:
+		return nil, &UnknownOperationError{Operation: op}
+	}
+}
+
+// maxExactDigits ограничивает число знаков, до которого round округляет в точном режиме.
+const maxExactDigits = 1000
+
+// maxExactExponent ограничивает показатель степени, чтобы 2^1e9 не занял всю память.
+const maxExactExponent = 10000
+
+// MaxExactBits ограничивает длину числителя и знаменателя операндов и
+// результатов точного режима. Одного ограничения показателя мало:
+// ((2^10000)^10000)^10000 займёт всю память агента, а после истечения аренды
+// задача достанется следующему агенту.
+const MaxExactBits = 1 << 20
+
+// ratBits возвращает длину в битах большего из числителя и знаменателя.
+func ratBits(r *big.Rat) int {
+	return max(r.Num().BitLen(), r.Denom().BitLen())
+}
+
+// FitsExact сообщает, что числитель и знаменатель дроби не длиннее
+// MaxExactBits. Оркестратор проверяет так числа выражения до планирования.
+func FitsExact(r *big.Rat) bool {
+	return ratBits(r) <= MaxExactBits
+}
+
+// checkExactSize отклоняет операнд или результат длиннее MaxExactBits.
+func checkExactSize(op string, r *big.Rat) error {
+	if !FitsExact(r) {
+		return &DomainError{Function: op, Message: fmt.Sprintf("numbers longer than %d bits are not supported in exact mode", MaxExactBits)}
+	}
+	return nil
+}
+
+func powRat(a, b *big.Rat) (*big.Rat, error) {
+	if !b.IsInt() {
+		return nil, &DomainError{Function: "^", Message: "exponent must be an integer in exact mode"}
+	}
+	if !b.Num().IsInt64() || b.Num().Int64() > maxExactExponent || b.Num().Int64() < -maxExactExponent {
+		return nil, &DomainError{Function: "^", Message: fmt.Sprintf("exponent magnitude must not exceed %d in exact mode", maxExactExponent)}
+	}
+	exp := b.Num().Int64()
+	if exp < 0 {
+		if a.Sign() == 0 {
+			return nil, ErrDivisionByZero
+		}
+		a, exp = new(big.Rat).Inv(a), -exp
+	}
+	// Длина степени не больше exp длин основания: проверяем до вычисления
+	if int64(ratBits(a))*exp > MaxExactBits {
+		return nil, &DomainError{Function: "^", Message: fmt.Sprintf("result would be longer than %d bits in exact mode", MaxExactBits)}
+	}
+	e := big.NewInt(exp)
+	num := new(big.Int).Exp(a.Num(), e, nil)
+	den := new(big.Int).Exp(a.Denom(), e, nil)
+	return new(big.Rat).SetFrac(num, den), nil
+}
+
+// CallRat вызывает функцию, поддерживающую точный режим.
+func CallRat(name string, args []*big.Rat) (*big.Rat, error) {
+	fn, ok := exactFunctions[name]
+	if !ok {
+		return nil, &UnknownOperationError{Operation: name}
+	}
+	if err := functions[name].CheckArity(len(args)); err != nil {
+		return nil, err
+	}
+	return fn(args)
+}
+
+// ExecuteExact выполняет задачу точного режима: аргументы и результат —
+// несократимые дроби в строковом виде.
+func ExecuteExact(task *models.Task) (string, error) {
+	result, err := executeRat(task)
+	if err != nil {
+		return "", err
+	}
+	return result.RatString(), nil
+}
+
+// executeRat вычисляет задачу над рациональными значениями из task.Values.
+func executeRat(task *models.Task) (*big.Rat, error) {
+	args := make([]*big.Rat, len(task.Values))
+	for i, v := range task.Values {
+		r, err := ParseRat(v)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkExactSize(task.Operation, r); err != nil {
+			return nil, err
+		}
+		args[i] = r
+	}
+
+	var result *big.Rat
+	var err error
+	if _, ok := functions[task.Operation]; ok {
+		result, err = CallRat(task.Operation, args)
+	} else if len(args) != 2 {
+		return nil, fmt.Errorf("operation %q expects 2 values, got %d", task.Operation, len(args))
+	} else {
+		result, err = ApplyRat(task.Operation, args[0], args[1])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, checkExactSize(task.Operation, result)
+}
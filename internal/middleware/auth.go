@@ -2,39 +2,67 @@ package middleware
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"strings"
 
 	"github.com/dimakirio/calculatorv1/internal/auth"
 )
 
+// contextKey — тип ключей контекста пакета; не пересекается со строковыми
+// ключами других пакетов.
+type contextKey int
+
+const userKey contextKey = iota
+
+// User — аутентифицированный пользователь запроса.
+type User struct {
+	ID    int64
+	Login string
+}
+
+// WithUser возвращает контекст с пользователем запроса.
+func WithUser(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// UserFromContext возвращает пользователя, которого AuthMiddleware положил в контекст.
+func UserFromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(userKey).(User)
+	return user, ok
+}
+
 func AuthMiddleware(jwtService *auth.JWTService) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
 			if authHeader == "" {
-				http.Error(w, "Authorization header is required", http.StatusUnauthorized)
+				writeUnauthorized(w, "Authorization header is required")
 				return
 			}
 
 			parts := strings.Split(authHeader, " ")
 			if len(parts) != 2 || parts[0] != "Bearer" {
-				http.Error(w, "Invalid authorization header", http.StatusUnauthorized)
+				writeUnauthorized(w, "Invalid authorization header")
 				return
 			}
 
 			claims, err := jwtService.ValidateToken(parts[1])
 			if err != nil {
-				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				writeUnauthorized(w, "Invalid token")
 				return
 			}
 
 			// Add user info to request context
-			ctx := r.Context()
-			ctx = context.WithValue(ctx, "user_id", claims.UserID)
-			ctx = context.WithValue(ctx, "user_login", claims.Login)
+			ctx := WithUser(r.Context(), User{ID: claims.UserID, Login: claims.Login})
 
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+func writeUnauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
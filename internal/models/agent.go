@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// Состояния агента в реестре оркестратора.
+const (
+	AgentAlive = "alive"
+	AgentDead  = "dead" // пропустил несколько heartbeat подряд
+)
+
+// Agent — зарегистрированный у оркестратора агент. ID агент выбирает сам при
+// запуске; Workers — сколько задач он вычисляет одновременно.
+type Agent struct {
+	ID           string    `json:"id"`
+	Hostname     string    `json:"hostname"`
+	Workers      int       `json:"workers"`
+	Status       string    `json:"status"`
+	RegisteredAt time.Time `json:"registered_at"`
+	LastSeenAt   time.Time `json:"last_seen_at"` // время последнего heartbeat
+	Tasks        []Task    `json:"tasks"`        // задачи, выданные агенту сейчас
+}
@@ -2,6 +2,11 @@ package models
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dimakirio/calculatorv1/pkg/config"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -9,44 +14,52 @@ type Database struct {
 	db *sql.DB
 }
 
-func NewDatabase(dbPath string) (*Database, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+// NewDatabase открывает базу по cfg.DBPath и применяет недостающие миграции.
+// Открывается один раз при запуске, соединения используются всеми запросами.
+func NewDatabase(cfg *config.Config) (*Database, error) {
+	d, err := OpenDatabase(cfg)
 	if err != nil {
 		return nil, err
 	}
-
-	// Create users table
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			login TEXT UNIQUE NOT NULL,
-			password_hash TEXT NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
-	if err != nil {
+	if _, err := d.Migrate(); err != nil {
+		d.Close()
 		return nil, err
 	}
+	return d, nil
+}
 
-	// Create expressions table
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS expressions (
-			id TEXT PRIMARY KEY,
-			user_id INTEGER NOT NULL,
-			expression TEXT NOT NULL,
-			status TEXT NOT NULL,
-			result REAL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (user_id) REFERENCES users(id)
-		)
-	`)
+// OpenDatabase открывает базу, не меняя её схему.
+func OpenDatabase(cfg *config.Config) (*Database, error) {
+	db, err := sql.Open("sqlite3", dsn(cfg))
 	if err != nil {
 		return nil, err
 	}
-
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(cfg.DBConnMaxLifetimeMS) * time.Millisecond)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
 	return &Database{db: db}, nil
 }
 
+// dsn дополняет путь к базе параметрами драйвера: они применяются к каждому
+// соединению пула, а не только к первому, как PRAGMA.
+func dsn(cfg *config.Config) string {
+	// Транзакции сразу берут блокировку записи: иначе две транзакции, начавшие
+	// с чтения, не смогут обе перейти к записи и одна получит SQLITE_BUSY.
+	params := []string{fmt.Sprintf("_busy_timeout=%d", cfg.DBBusyTimeoutMS), "_txlock=immediate"}
+	if cfg.DBWAL {
+		params = append(params, "_journal_mode=WAL")
+	}
+	sep := "?"
+	if strings.Contains(cfg.DBPath, "?") {
+		sep = "&"
+	}
+	return cfg.DBPath + sep + strings.Join(params, "&")
+}
+
 func (d *Database) Close() error {
 	return d.db.Close()
 }
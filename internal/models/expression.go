@@ -1,7 +1,276 @@
 package models
 
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
 type Expression struct {
-	ID     string
-	Status string
-	Result float64
+	ID         string                 `json:"id"`
+	UserID     int64                  `json:"user_id"` // владелец выражения
+	Expression string                 `json:"expression"`
+	Status     ExpressionStatus       `json:"status"`
+	Result     float64                `json:"result"`
+	Variables  map[string]json.Number `json:"variables,omitempty"` // значения переменных, с которыми выражение было отправлено
+
+	// Mode — режим вычисления. В точном режиме результат дополнительно
+	// хранится несократимой дробью и десятичной записью с Digits знаками
+	// после запятой, в десятичном — записью с Scale знаками, округлённой
+	// способом Rounding.
+	Mode           string `json:"mode"`
+	Digits         int    `json:"digits,omitempty"`
+	Scale          int    `json:"scale,omitempty"`
+	Rounding       string `json:"rounding,omitempty"`
+	ResultFraction string `json:"result_fraction,omitempty"`
+	ResultDecimal  string `json:"result_decimal,omitempty"`
+
+	// Error — ошибка задачи, из-за которой выражение не удалось вычислить.
+	Error *TaskError `json:"error"`
+
+	// CreatedAt — время приёма выражения, StartedAt — выдачи агенту первой
+	// задачи, FinishedAt — получения результата или ошибки. DurationMS —
+	// сколько длилось вычисление: от начала (или приёма, если агенты не
+	// понадобились) до окончания.
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	DurationMS *int64     `json:"duration_ms"`
+
+	// Transitions — статусы, через которые прошло выражение, с временем
+	// перехода в каждый, начиная с pending.
+	Transitions []StatusTransition `json:"transitions"`
+}
+
+var ErrExpressionNotFound = errors.New("expression not found")
+
+type ExpressionRepository struct {
+	db *sql.DB
+}
+
+func NewExpressionRepository(db *sql.DB) *ExpressionRepository {
+	return &ExpressionRepository{db: db}
+}
+
+const expressionColumnList = `id, user_id, expression, status, result, variables, mode, digits, scale,
+	rounding, result_fraction, result_decimal, error_code, error_message, created_at, started_at, finished_at,
+	transitions`
+
+// Create сохраняет новое выражение. Если CreatedAt не задан, им становится
+// текущее время; если не задана история статусов, она начинается с текущего
+// статуса в момент CreatedAt.
+func (r *ExpressionRepository) Create(expr *Expression) error {
+	variables, err := encodeVariables(expr.Variables)
+	if err != nil {
+		return err
+	}
+	if expr.CreatedAt.IsZero() {
+		expr.CreatedAt = time.Now()
+	}
+	if len(expr.Transitions) == 0 {
+		expr.Transitions = []StatusTransition{{Status: expr.Status, At: expr.CreatedAt}}
+	}
+	transitions, err := encodeTransitions(expr.Transitions)
+	if err != nil {
+		return err
+	}
+	expr.DurationMS = duration(expr)
+	_, err = r.db.Exec(`INSERT INTO expressions (`+expressionColumnList+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		expr.ID, expr.UserID, expr.Expression, expr.Status, nullableResult(expr), variables,
+		expr.Mode, expr.Digits, expr.Scale, expr.Rounding, expr.ResultFraction, expr.ResultDecimal,
+		errorCode(expr.Error), errorMessage(expr.Error),
+		sqliteTime(expr.CreatedAt), nullableTime(expr.StartedAt), nullableTime(expr.FinishedAt),
+		transitions)
+	return err
+}
+
+func (r *ExpressionRepository) GetByID(id string) (*Expression, error) {
+	row := r.db.QueryRow("SELECT "+expressionColumnList+" FROM expressions WHERE id = ?", id)
+	expr, err := scanExpression(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrExpressionNotFound
+		}
+		return nil, err
+	}
+	return expr, nil
+}
+
+// ListUnfinished возвращает выражения, которые ещё не дошли до конечного
+// статуса, в порядке создания.
+func (r *ExpressionRepository) ListUnfinished() ([]Expression, error) {
+	return r.query("SELECT " + expressionColumnList + " FROM expressions" +
+		" WHERE status IN ('pending', 'queued', 'in_progress') ORDER BY created_at, rowid")
+}
+
+func (r *ExpressionRepository) query(query string, args ...interface{}) ([]Expression, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exprs []Expression
+	for rows.Next() {
+		expr, err := scanExpression(rows)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, *expr)
+	}
+	return exprs, rows.Err()
+}
+
+// Update сохраняет статус с историей переходов, результат и время начала и
+// окончания выражения; исходные поля запроса не меняются. Статус меняется
+// через Expression.Transition, который проверяет допустимость перехода.
+func (r *ExpressionRepository) Update(expr *Expression) error {
+	transitions, err := encodeTransitions(expr.Transitions)
+	if err != nil {
+		return err
+	}
+	expr.DurationMS = duration(expr)
+	res, err := r.db.Exec(`UPDATE expressions SET status = ?, result = ?, result_fraction = ?,
+		result_decimal = ?, error_code = ?, error_message = ?, started_at = ?, finished_at = ?,
+		transitions = ? WHERE id = ?`,
+		expr.Status, nullableResult(expr), expr.ResultFraction, expr.ResultDecimal,
+		errorCode(expr.Error), errorMessage(expr.Error), nullableTime(expr.StartedAt),
+		nullableTime(expr.FinishedAt), transitions, expr.ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrExpressionNotFound
+	}
+	return nil
+}
+
+// scanner — общий интерфейс *sql.Row и *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanExpression(s scanner) (*Expression, error) {
+	var expr Expression
+	var result sql.NullFloat64
+	var variables, code, message, transitions string
+	var startedAt, finishedAt sql.NullTime
+	err := s.Scan(&expr.ID, &expr.UserID, &expr.Expression, &expr.Status, &result, &variables,
+		&expr.Mode, &expr.Digits, &expr.Scale, &expr.Rounding, &expr.ResultFraction, &expr.ResultDecimal,
+		&code, &message, &expr.CreatedAt, &startedAt, &finishedAt, &transitions)
+	if err != nil {
+		return nil, err
+	}
+	expr.Result = result.Float64
+	if startedAt.Valid {
+		expr.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		expr.FinishedAt = &finishedAt.Time
+	}
+	expr.DurationMS = duration(&expr)
+	if variables != "" {
+		if err := json.Unmarshal([]byte(variables), &expr.Variables); err != nil {
+			return nil, err
+		}
+	}
+	if code != "" {
+		expr.Error = &TaskError{Code: code, Message: message}
+	}
+	if transitions != "" {
+		if err := json.Unmarshal([]byte(transitions), &expr.Transitions); err != nil {
+			return nil, err
+		}
+	} else {
+		expr.Transitions = legacyTransitions(&expr)
+	}
+	return &expr, nil
+}
+
+// legacyTransitions восстанавливает историю статусов выражения, сохранённого
+// до её появления, по времени приёма, начала и окончания.
+func legacyTransitions(expr *Expression) []StatusTransition {
+	history := []StatusTransition{{Status: StatusPending, At: expr.CreatedAt}}
+	if expr.StartedAt != nil {
+		history = append(history, StatusTransition{Status: StatusInProgress, At: *expr.StartedAt})
+	}
+	if expr.FinishedAt != nil {
+		history = append(history, StatusTransition{Status: expr.Status, At: *expr.FinishedAt})
+	} else if expr.Status != history[len(history)-1].Status {
+		history = append(history, StatusTransition{Status: expr.Status, At: expr.CreatedAt})
+	}
+	return history
+}
+
+func encodeVariables(variables map[string]json.Number) (string, error) {
+	if len(variables) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(variables)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// encodeTransitions хранит время переходов с той же точностью, что и
+// колонки времени, чтобы оно совпадало с started_at и finished_at.
+func encodeTransitions(transitions []StatusTransition) (string, error) {
+	stored := make([]StatusTransition, len(transitions))
+	for i, tr := range transitions {
+		stored[i] = StatusTransition{Status: tr.Status, At: tr.At.UTC().Truncate(time.Microsecond)}
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// nullableResult хранит NULL вместо результата, пока выражение не вычислено.
+func nullableResult(expr *Expression) interface{} {
+	if expr.Status != StatusCompleted {
+		return nil
+	}
+	return expr.Result
+}
+
+func nullableTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return sqliteTime(*t)
+}
+
+// duration считает длительность вычисления законченного выражения в миллисекундах.
+func duration(expr *Expression) *int64 {
+	if expr.FinishedAt == nil {
+		return nil
+	}
+	start := expr.CreatedAt
+	if expr.StartedAt != nil {
+		start = *expr.StartedAt
+	}
+	ms := expr.FinishedAt.Sub(start).Milliseconds()
+	return &ms
+}
+
+func errorCode(e *TaskError) string {
+	if e == nil {
+		return ""
+	}
+	return e.Code
+}
+
+func errorMessage(e *TaskError) string {
+	if e == nil {
+		return ""
+	}
+	return e.Message
 }
@@ -0,0 +1,156 @@
+package models
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Поля, по которым сортируется список выражений.
+const (
+	SortCreatedAt = "created_at"
+	SortResult    = "result" // невычисленные выражения (без результата) идут после вычисленных
+)
+
+// ErrInvalidCursor — курсор испорчен или указывает на чужое выражение.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ExpressionFilter — параметры выборки страницы выражений пользователя.
+// Пустые Statuses и нулевые границы CreatedFrom/CreatedTo не ограничивают
+// выборку; CreatedTo не включается в диапазон.
+type ExpressionFilter struct {
+	UserID      int64
+	Statuses    []ExpressionStatus
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	Sort        string
+	Descending  bool
+	Limit       int
+	Cursor      string // NextCursor предыдущей страницы
+}
+
+// ExpressionPage — страница выражений. Total — число выражений, подходящих
+// под фильтр, по всем страницам; NextCursor пуст на последней странице.
+type ExpressionPage struct {
+	Expressions []Expression
+	NextCursor  string
+	Total       int
+}
+
+// sortKey — выражение SQL, по которому упорядочивается выборка; %[1]s —
+// псевдоним таблицы. Последний ключ всегда rowid, чтобы порядок был полным.
+type sortKey struct {
+	expr string
+	desc bool
+}
+
+func sortKeys(sort string, desc bool) ([]sortKey, error) {
+	switch sort {
+	case "", SortCreatedAt:
+		return []sortKey{{"%[1]s.created_at", desc}, {"%[1]s.rowid", desc}}, nil
+	case SortResult:
+		return []sortKey{{"(%[1]s.result IS NULL)", false}, {"COALESCE(%[1]s.result, 0)", desc}, {"%[1]s.rowid", desc}}, nil
+	default:
+		return nil, fmt.Errorf("unknown sort field %q", sort)
+	}
+}
+
+// keyset строит условие «строка идёт после курсора» для ключей keys:
+// (k0 > c0) OR (k0 = c0 AND ((k1 > c1) OR (k1 = c1 AND ...))).
+func keyset(keys []sortKey) string {
+	k := keys[0]
+	op := ">"
+	if k.desc {
+		op = "<"
+	}
+	row, cursor := fmt.Sprintf(k.expr, "e"), fmt.Sprintf(k.expr, "c")
+	if len(keys) == 1 {
+		return fmt.Sprintf("%s %s %s", row, op, cursor)
+	}
+	return fmt.Sprintf("(%s %s %s OR (%s = %s AND %s))", row, op, cursor, row, cursor, keyset(keys[1:]))
+}
+
+// ListPage возвращает страницу выражений пользователя. Пагинация курсорная:
+// следующая страница начинается сразу после последнего выражения текущей,
+// поэтому новые выражения не сдвигают уже выданные страницы.
+func (r *ExpressionRepository) ListPage(f ExpressionFilter) (*ExpressionPage, error) {
+	keys, err := sortKeys(f.Sort, f.Descending)
+	if err != nil {
+		return nil, err
+	}
+
+	where := []string{"e.user_id = ?"}
+	args := []interface{}{f.UserID}
+	if len(f.Statuses) > 0 {
+		where = append(where, "e.status IN (?"+strings.Repeat(", ?", len(f.Statuses)-1)+")")
+		for _, s := range f.Statuses {
+			args = append(args, s)
+		}
+	}
+	if !f.CreatedFrom.IsZero() {
+		where = append(where, "e.created_at >= ?")
+		args = append(args, sqliteTime(f.CreatedFrom))
+	}
+	if !f.CreatedTo.IsZero() {
+		where = append(where, "e.created_at < ?")
+		args = append(args, sqliteTime(f.CreatedTo))
+	}
+
+	page := &ExpressionPage{}
+	err = r.db.QueryRow("SELECT COUNT(*) FROM expressions e WHERE "+strings.Join(where, " AND "), args...).Scan(&page.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	from := "expressions e"
+	if f.Cursor != "" {
+		id, err := base64.RawURLEncoding.DecodeString(f.Cursor)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		var found int
+		err = r.db.QueryRow("SELECT COUNT(*) FROM expressions WHERE id = ? AND user_id = ?", string(id), f.UserID).Scan(&found)
+		if err != nil {
+			return nil, err
+		}
+		if found == 0 {
+			return nil, ErrInvalidCursor
+		}
+		from = "expressions e, expressions c"
+		where = append(where, "c.id = ?", keyset(keys))
+		args = append(args, string(id))
+	}
+
+	order := make([]string, len(keys))
+	for i, k := range keys {
+		order[i] = fmt.Sprintf(k.expr, "e")
+		if k.desc {
+			order[i] += " DESC"
+		}
+	}
+	columns := strings.Split(expressionColumnList, ",")
+	for i, c := range columns {
+		columns[i] = "e." + strings.TrimSpace(c)
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s LIMIT ?",
+		strings.Join(columns, ", "), from, strings.Join(where, " AND "), strings.Join(order, ", "))
+	// Лишняя строка показывает, что за этой страницей есть ещё одна
+	exprs, err := r.query(query, append(args, f.Limit+1)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(exprs) > f.Limit {
+		exprs = exprs[:f.Limit]
+		page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(exprs[len(exprs)-1].ID))
+	}
+	page.Expressions = exprs
+	return page, nil
+}
+
+// sqliteTime форматирует время в UTC как CURRENT_TIMESTAMP, но с
+// микросекундами фиксированной ширины, чтобы строки сравнивались по порядку.
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05.000000")
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// ExpressionStatus — этап жизненного цикла выражения.
+type ExpressionStatus string
+
+const (
+	StatusPending    ExpressionStatus = "pending"     // принято, задачи ещё не созданы
+	StatusQueued     ExpressionStatus = "queued"      // задачи в очереди, агенты их ещё не брали
+	StatusInProgress ExpressionStatus = "in_progress" // агент получил хотя бы одну задачу
+	StatusCompleted  ExpressionStatus = "completed"
+	StatusFailed     ExpressionStatus = "failed"
+	StatusCancelled  ExpressionStatus = "cancelled"
+)
+
+// transitions — допустимые переходы между статусами. Выражение без операций
+// вычисляется сразу при приёме, поэтому из pending можно попасть в completed.
+// Из конечных статусов переходов нет.
+var transitions = map[ExpressionStatus][]ExpressionStatus{
+	StatusPending:    {StatusQueued, StatusCompleted, StatusFailed, StatusCancelled},
+	StatusQueued:     {StatusInProgress, StatusFailed, StatusCancelled},
+	StatusInProgress: {StatusCompleted, StatusFailed, StatusCancelled},
+}
+
+// ExpressionStatuses перечисляет все статусы в порядке жизненного цикла.
+func ExpressionStatuses() []ExpressionStatus {
+	return []ExpressionStatus{StatusPending, StatusQueued, StatusInProgress, StatusCompleted, StatusFailed, StatusCancelled}
+}
+
+// Valid сообщает, что статус известен.
+func (s ExpressionStatus) Valid() bool {
+	for _, status := range ExpressionStatuses() {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Terminal сообщает, что выражение с этим статусом больше не изменится.
+func (s ExpressionStatus) Terminal() bool {
+	return s == StatusCompleted || s == StatusFailed || s == StatusCancelled
+}
+
+// CanTransition сообщает, разрешён ли переход из s в to.
+func (s ExpressionStatus) CanTransition(to ExpressionStatus) bool {
+	for _, next := range transitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusTransition — момент, когда выражение получило статус.
+type StatusTransition struct {
+	Status ExpressionStatus `json:"status"`
+	At     time.Time        `json:"at"`
+}
+
+// TransitionError — попытка перехода, которого нет в таблице переходов.
+type TransitionError struct {
+	ID       string
+	From, To ExpressionStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("expression %s: illegal status transition %s -> %s", e.ID, e.From, e.To)
+}
+
+// Transition переводит выражение в статус to и записывает время перехода.
+// Переход в in_progress задаёт StartedAt, в конечный статус — FinishedAt.
+func (e *Expression) Transition(to ExpressionStatus, at time.Time) error {
+	if !e.Status.CanTransition(to) {
+		return &TransitionError{ID: e.ID, From: e.Status, To: to}
+	}
+	e.Status = to
+	e.Transitions = append(e.Transitions, StatusTransition{Status: to, At: at})
+	switch {
+	case to == StatusInProgress:
+		e.StartedAt = &at
+	case to.Terminal():
+		e.FinishedAt = &at
+	}
+	e.DurationMS = duration(e)
+	return nil
+}
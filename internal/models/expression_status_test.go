@@ -0,0 +1,48 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestExpressionTransitions(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	expr := &Expression{ID: "e", Status: StatusPending, CreatedAt: created}
+	for i, to := range []ExpressionStatus{StatusQueued, StatusInProgress, StatusCompleted} {
+		if err := expr.Transition(to, created.Add(time.Duration(i+1)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expr.StartedAt == nil || !expr.StartedAt.Equal(created.Add(2*time.Second)) {
+		t.Errorf("expected start at the in_progress transition, got %v", expr.StartedAt)
+	}
+	if expr.DurationMS == nil || *expr.DurationMS != 1000 {
+		t.Errorf("expected duration of 1000ms, got %v", expr.DurationMS)
+	}
+
+	tests := []struct {
+		from, to ExpressionStatus
+		ok       bool
+	}{
+		{StatusPending, StatusCompleted, true},
+		{StatusPending, StatusInProgress, false},
+		{StatusQueued, StatusCompleted, false},
+		{StatusQueued, StatusCancelled, true},
+		{StatusInProgress, StatusQueued, false},
+		{StatusCompleted, StatusFailed, false},
+		{StatusCancelled, StatusCompleted, false},
+		{StatusFailed, StatusFailed, false},
+	}
+	for _, test := range tests {
+		expr := &Expression{ID: "e", Status: test.from}
+		err := expr.Transition(test.to, created)
+		var transitionErr *TransitionError
+		if test.ok != (err == nil) || (err != nil && !errors.As(err, &transitionErr)) {
+			t.Errorf("%s -> %s: unexpected result %v", test.from, test.to, err)
+		}
+		if err != nil && (expr.Status != test.from || len(expr.Transitions) != 0) {
+			t.Errorf("%s -> %s: rejected transition changed the expression: %+v", test.from, test.to, expr)
+		}
+	}
+}
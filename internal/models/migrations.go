@@ -0,0 +1,235 @@
+package models
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Миграции схемы лежат в migrations/NNNN_name.sql и применяются по порядку
+// номеров. Применённая миграция никогда не меняется — изменения схемы
+// добавляются новым файлом со следующим номером.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration — одна версия схемы базы.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// MigrationStatus — миграция и признак того, что она уже применена к базе.
+type MigrationStatus struct {
+	Migration
+	Applied bool
+}
+
+// SchemaTooNewError — база обновлена более новой версией сервиса, чем запущенная.
+type SchemaTooNewError struct {
+	Version int
+	Latest  int
+}
+
+func (e *SchemaTooNewError) Error() string {
+	return fmt.Sprintf("database schema version %d is newer than the latest known version %d", e.Version, e.Latest)
+}
+
+// Migrations возвращает все встроенные миграции, упорядоченные по версии.
+// Версии должны идти подряд с 1.
+func Migrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	var migrations []Migration
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		prefix, title, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("migration %s: file name must be NNNN_name.sql", entry.Name())
+		}
+		data, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: title, SQL: string(data)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %04d_%s: expected version %d", m.Version, m.Name, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// SchemaVersion возвращает версию схемы базы: номер последней применённой миграции.
+func (d *Database) SchemaVersion() (int, error) {
+	if err := d.ensureSchemaVersion(); err != nil {
+		return 0, err
+	}
+	return schemaVersion(d.db)
+}
+
+// MigrationStatus перечисляет встроенные миграции и отмечает применённые.
+func (d *Database) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	version, err := d.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	status := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		status[i] = MigrationStatus{Migration: m, Applied: m.Version <= version}
+	}
+	return status, nil
+}
+
+// Migrate применяет к базе недостающие миграции, каждую в своей транзакции,
+// и возвращает применённые. Если схема новее известных миграций, база не
+// трогается и возвращается *SchemaTooNewError.
+func (d *Database) Migrate() ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	version, err := d.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if latest := len(migrations); version > latest {
+		return nil, &SchemaTooNewError{Version: version, Latest: latest}
+	}
+
+	var applied []Migration
+	for _, m := range migrations[version:] {
+		ok, err := d.apply(m)
+		if err != nil {
+			return applied, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if ok {
+			applied = append(applied, m)
+		}
+	}
+	return applied, nil
+}
+
+// apply выполняет миграцию и записывает её версию в одной транзакции. Версия
+// перечитывается внутри транзакции: если другой процесс уже применил
+// миграцию, она пропускается.
+func (d *Database) apply(m Migration) (bool, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return false, err
+	}
+	if version >= m.Version {
+		return false, nil
+	}
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_version (version, name) VALUES (?, ?)", m.Version, m.Name); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// ensureSchemaVersion создаёт таблицу версий. Базе, созданной до появления
+// миграций, засчитываются миграции, которые описывают её существующую схему.
+func (d *Database) ensureSchemaVersion() error {
+	var exists int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'").Scan(&exists)
+	if err != nil || exists > 0 {
+		return err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	legacy, err := legacyVersion(tx)
+	if err != nil {
+		return err
+	}
+	if legacy > 0 {
+		migrations, err := Migrations()
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations[:legacy] {
+			if _, err := tx.Exec("INSERT OR IGNORE INTO schema_version (version, name) VALUES (?, ?)", m.Version, m.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// legacyVersion определяет по таблицам и колонкам, какой миграции
+// соответствует схема базы без таблицы версий.
+func legacyVersion(q querier) (int, error) {
+	has := func(query string, args ...interface{}) (bool, error) {
+		var n int
+		err := q.QueryRow(query, args...).Scan(&n)
+		return n > 0, err
+	}
+	checks := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", []interface{}{"users"}},
+		{"SELECT COUNT(*) FROM pragma_table_info('expressions') WHERE name = ?", []interface{}{"error_message"}},
+		{"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", []interface{}{"tasks"}},
+	}
+	version := 0
+	for _, c := range checks {
+		ok, err := has(c.query, c.args...)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+		version++
+	}
+	return version, nil
+}
+
+// querier — общий интерфейс *sql.DB и *sql.Tx для чтения.
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func schemaVersion(q querier) (int, error) {
+	var version int
+	err := q.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
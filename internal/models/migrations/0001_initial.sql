@@ -0,0 +1,17 @@
+-- Исходная схема: пользователи и их выражения.
+CREATE TABLE users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	login TEXT UNIQUE NOT NULL,
+	password_hash TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE expressions (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	expression TEXT NOT NULL,
+	status TEXT NOT NULL,
+	result REAL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
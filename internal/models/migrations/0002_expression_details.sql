@@ -0,0 +1,10 @@
+-- Переменные, режим вычисления, точный результат и ошибка выражения.
+ALTER TABLE expressions ADD COLUMN variables TEXT NOT NULL DEFAULT '';
+ALTER TABLE expressions ADD COLUMN mode TEXT NOT NULL DEFAULT 'float';
+ALTER TABLE expressions ADD COLUMN digits INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE expressions ADD COLUMN scale INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE expressions ADD COLUMN rounding TEXT NOT NULL DEFAULT '';
+ALTER TABLE expressions ADD COLUMN result_fraction TEXT NOT NULL DEFAULT '';
+ALTER TABLE expressions ADD COLUMN result_decimal TEXT NOT NULL DEFAULT '';
+ALTER TABLE expressions ADD COLUMN error_code TEXT NOT NULL DEFAULT '';
+ALTER TABLE expressions ADD COLUMN error_message TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,13 @@
+-- Граф задач незавершённых выражений; задача хранится в payload в JSON агентов.
+CREATE TABLE tasks (
+	id TEXT PRIMARY KEY,
+	expression_id TEXT NOT NULL,
+	parent_id TEXT NOT NULL DEFAULT '',
+	slot INTEGER NOT NULL,
+	waiting INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	FOREIGN KEY (expression_id) REFERENCES expressions(id)
+);
+
+CREATE INDEX idx_tasks_expression_id ON tasks (expression_id);
@@ -0,0 +1,2 @@
+-- Индекс для постраничной выдачи истории выражений пользователя.
+CREATE INDEX idx_expressions_user_created ON expressions (user_id, created_at);
@@ -0,0 +1,3 @@
+-- Время начала и окончания вычисления выражения.
+ALTER TABLE expressions ADD COLUMN started_at TIMESTAMP;
+ALTER TABLE expressions ADD COLUMN finished_at TIMESTAMP;
@@ -0,0 +1,9 @@
+-- История смены статусов выражения в JSON: [{"status": ..., "at": ...}].
+ALTER TABLE expressions ADD COLUMN transitions TEXT NOT NULL DEFAULT '';
+
+-- Раньше выражение оставалось pending, пока не будет вычислено. Выражения с
+-- задачами в очереди переводятся в queued, уже начатые — в in_progress.
+UPDATE expressions SET status = 'in_progress'
+	WHERE status = 'pending' AND started_at IS NOT NULL;
+UPDATE expressions SET status = 'queued'
+	WHERE status = 'pending' AND id IN (SELECT expression_id FROM tasks);
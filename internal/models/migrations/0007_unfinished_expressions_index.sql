@@ -0,0 +1,4 @@
+-- Индекс для поиска незавершённых выражений при запуске оркестратора:
+-- завершённые выражения в него не попадают.
+CREATE INDEX idx_expressions_unfinished ON expressions (created_at)
+	WHERE status IN ('pending', 'queued', 'in_progress');
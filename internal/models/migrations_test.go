@@ -0,0 +1,93 @@
+package models
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/dimakirio/calculatorv1/pkg/config"
+)
+
+func testConfig(t *testing.T) *config.Config {
+	cfg := config.LoadConfig()
+	cfg.DBPath = filepath.Join(t.TempDir(), "calc.db")
+	return cfg
+}
+
+func TestMigrateFreshDatabase(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenDatabase(testConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	applied, err := db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("expected %d migrations applied, got %d", len(migrations), len(applied))
+	}
+	if version, err := db.SchemaVersion(); err != nil || version != len(migrations) {
+		t.Fatalf("expected schema version %d, got %d (%v)", len(migrations), version, err)
+	}
+
+	// Повторный запуск ничего не делает
+	if applied, err := db.Migrate(); err != nil || len(applied) != 0 {
+		t.Fatalf("expected no migrations on second run, got %v (%v)", applied, err)
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	cfg := testConfig(t)
+	db, err := OpenDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Схема, которую создавала версия сервиса без миграций
+	_, err = db.DB().Exec(`
+		CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, login TEXT UNIQUE NOT NULL, password_hash TEXT NOT NULL, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
+		CREATE TABLE expressions (id TEXT PRIMARY KEY, user_id INTEGER NOT NULL, expression TEXT NOT NULL, status TEXT NOT NULL, result REAL, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
+		INSERT INTO expressions (id, user_id, expression, status, result) VALUES ('old', 1, '2 + 2', 'completed', 4);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) == 0 || applied[0].Version != 2 {
+		t.Fatalf("expected migrations to start from version 2, got %+v", applied)
+	}
+	expr, err := NewExpressionRepository(db.DB()).GetByID("old")
+	if err != nil || expr.Result != 4 || expr.Mode != ModeFloat {
+		t.Fatalf("expected legacy expression to survive migration, got %+v (%v)", expr, err)
+	}
+}
+
+func TestRefuseNewerSchema(t *testing.T) {
+	cfg := testConfig(t)
+	db, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DB().Exec("INSERT INTO schema_version (version, name) VALUES (1000, 'future')"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	_, err = NewDatabase(cfg)
+	var tooNew *SchemaTooNewError
+	if !errors.As(err, &tooNew) || tooNew.Version != 1000 {
+		t.Fatalf("expected SchemaTooNewError, got %v", err)
+	}
+}
@@ -1,11 +1,197 @@
 package models
 
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Операции, которые может содержать Task.Operation. Кроме них Operation может
+// быть именем функции из белого списка (sqrt, min, ...), тогда аргументы
+// передаются в Args, а не в Arg1 и Arg2.
+const (
+	OpAdd         = "+"
+	OpSubtract    = "-"
+	OpMultiply    = "*"
+	OpDivide      = "/"
+	OpPower       = "^"
+	OpModulo      = "%"
+	OpFloorDivide = "//"
+)
+
+// Режимы вычисления. В режиме ModeFloat аргументы передаются числами в
+// Arg1/Arg2/Args, в остальных — строками в Values, а результат — строкой.
+const (
+	ModeFloat   = "float"
+	ModeExact   = "exact"   // рациональные числа произвольной точности, "1/3"
+	ModeDecimal = "decimal" // фиксированная точка: результат каждой операции округляется до Scale знаков
+)
+
+// Способы округления десятичного режима.
+const (
+	RoundHalfEven = "half_even" // к ближайшему, половина — к чётному (банковское)
+	RoundHalfUp   = "half_up"   // к ближайшему, половина — от нуля
+	RoundDown     = "down"      // отбрасывание знаков, к нулю
+)
+
 type Task struct {
-	ID            string
-	Arg1          float64
-	Arg2          float64
-	Operation     string
-	OperationTime int
-	Status        string
-	Result        float64 // Добавлено поле Result
+	ID             string    `json:"id"`
+	Arg1           float64   `json:"arg1"`
+	Arg2           float64   `json:"arg2"`
+	Args           []float64 `json:"args,omitempty"`
+	Mode           string    `json:"mode,omitempty"`
+	Values         []string  `json:"values,omitempty"`
+	Scale          int       `json:"scale,omitempty"`
+	Rounding       string    `json:"rounding,omitempty"`
+	Operation      string    `json:"operation"`
+	OperationTime  int       `json:"operation_time"` // сколько миллисекунд агент выполняет операцию
+	Status         string    `json:"status,omitempty"`
+	Result         float64   `json:"-"` // Добавлено поле Result
+	LeaseID        string    `json:"lease_id"`
+	LeaseExpiresAt time.Time `json:"lease_expires_at"`
+	Attempts       int       `json:"attempts"`           // сколько раз задача выдавалась агентам
+	AgentID        string    `json:"agent_id,omitempty"` // агент, которому выдана задача
+}
+
+// Коды ошибок вычисления задачи.
+const (
+	ErrCodeDivisionByZero   = "division_by_zero"
+	ErrCodeNonFinite        = "non_finite_result"
+	ErrCodeDomain           = "domain_error"
+	ErrCodeInvalidArguments = "invalid_arguments"
+	ErrCodeUnknownOperation = "unknown_operation"
+	ErrCodeCalculation      = "calculation_error" // прочие ошибки агента
+	ErrCodeScheduling       = "scheduling_error"  // оркестратор не смог разложить выражение на задачи
+)
+
+// TaskError — структурированная ошибка, с которой агент не смог вычислить задачу.
+type TaskError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// TaskResult — результат задачи, который агент отправляет оркестратору:
+// ровно одно из Result (режим float), Value (точные режимы) и Error.
+type TaskResult struct {
+	ID      string     `json:"id"`
+	LeaseID string     `json:"lease_id"`
+	Result  *float64   `json:"result,omitempty"`
+	Value   string     `json:"value,omitempty"`
+	Error   *TaskError `json:"error,omitempty"`
+}
+
+// TaskAck — ответ оркестратора на один результат из пакета: Status — код
+// HTTP, с которым результат был бы принят или отклонён по отдельности.
+type TaskAck struct {
+	ID     string `json:"id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// TaskRecord — задача вместе с её местом в графе выражения: ParentID — задача,
+// в аргумент Slot которой подставляется результат (пусто у корневой задачи),
+// Waiting — сколько аргументов задачи ещё не вычислено.
+type TaskRecord struct {
+	Task         Task
+	ExpressionID string
+	ParentID     string
+	Slot         int
+	Waiting      int
+}
+
+type TaskRepository struct {
+	db *sql.DB
+}
+
+func NewTaskRepository(db *sql.DB) *TaskRepository {
+	return &TaskRepository{db: db}
+}
+
+// CreateGraph сохраняет все задачи выражения одной транзакцией.
+func (r *TaskRepository) CreateGraph(records []TaskRecord) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := range records {
+		if err := saveTask(tx, &records[i]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Save сохраняет текущее состояние задачи: аргументы, статус и аренду.
+func (r *TaskRepository) Save(record *TaskRecord) error {
+	return saveTask(r.db, record)
+}
+
+// Complete удаляет вычисленную задачу и сохраняет родителя с подставленным
+// результатом одной транзакцией, чтобы результат не потерялся между ними.
+func (r *TaskRepository) Complete(id string, parent *TaskRecord) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM tasks WHERE id = ?", id); err != nil {
+		return err
+	}
+	if parent != nil {
+		if err := saveTask(tx, parent); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteByExpression удаляет все оставшиеся задачи выражения.
+func (r *TaskRepository) DeleteByExpression(exprID string) error {
+	_, err := r.db.Exec("DELETE FROM tasks WHERE expression_id = ?", exprID)
+	return err
+}
+
+// List возвращает все сохранённые задачи в порядке создания.
+func (r *TaskRepository) List() ([]TaskRecord, error) {
+	rows, err := r.db.Query("SELECT expression_id, parent_id, slot, waiting, payload FROM tasks ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []TaskRecord
+	for rows.Next() {
+		var rec TaskRecord
+		var payload string
+		if err := rows.Scan(&rec.ExpressionID, &rec.ParentID, &rec.Slot, &rec.Waiting, &payload); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(payload), &rec.Task); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// execer — общий интерфейс *sql.DB и *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// saveTask вставляет или обновляет задачу. Сама задача хранится в payload
+// в том же JSON, что уходит агентам.
+func saveTask(e execer, rec *TaskRecord) error {
+	payload, err := json.Marshal(rec.Task)
+	if err != nil {
+		return err
+	}
+	_, err = e.Exec(`INSERT INTO tasks (id, expression_id, parent_id, slot, waiting, status, payload)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET waiting = excluded.waiting, status = excluded.status, payload = excluded.payload`,
+		rec.Task.ID, rec.ExpressionID, rec.ParentID, rec.Slot, rec.Waiting, rec.Task.Status, string(payload))
+	return err
 }
@@ -0,0 +1,138 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dimakirio/calculatorv1/internal/middleware"
+	"github.com/dimakirio/calculatorv1/internal/models"
+)
+
+// HandleRegisterAgent регистрирует агента при запуске:
+//
+//	POST /internal/agents — {"id", "hostname", "workers"}; ответ — агент,
+//	                        интервал heartbeat и наибольший размер пакета
+//	                        {"agent", "heartbeat_interval_ms", "task_batch_max"}.
+func (o *Orchestrator) HandleRegisterAgent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req struct {
+		ID       string `json:"id"`
+		Hostname string `json:"hostname"`
+		Workers  int    `json:"workers"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, "Invalid request body")
+		return
+	}
+	if req.ID == "" || req.Workers < 1 {
+		writeJSONError(w, http.StatusUnprocessableEntity, "Agent id and a positive number of workers required")
+		return
+	}
+
+	agent := o.agents.Register(req.ID, req.Hostname, req.Workers)
+	o.log.Info("Agent " + agent.ID + " registered from " + agent.Hostname + " with " + strconv.Itoa(agent.Workers) + " workers")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"agent":                 agent,
+		"heartbeat_interval_ms": o.cfg.AgentHeartbeatIntervalMS,
+		"task_batch_max":        o.cfg.TaskBatchMax,
+	})
+}
+
+// HandleAgentHeartbeat принимает heartbeat агента:
+//
+//	POST /internal/agents/{id}/heartbeat — 200, либо 404 для незарегистрированного
+//	                                       агента: ему нужно зарегистрироваться заново.
+func (o *Orchestrator) HandleAgentHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	id, ok := strings.CutSuffix(r.URL.Path[len("/internal/agents/"):], "/heartbeat")
+	if !ok || id == "" {
+		writeJSONError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	err := o.agents.Heartbeat(id)
+	if errors.Is(err, ErrAgentNotFound) {
+		writeJSONError(w, http.StatusNotFound, "Agent not found")
+		return
+	}
+	o.reapAgents()
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleGetAgents возвращает администратору всех агентов со временем
+// последнего heartbeat и выданными им задачами.
+func (o *Orchestrator) HandleGetAgents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if !o.requireAdmin(w, r) {
+		return
+	}
+
+	o.reapAgents()
+	agents := o.agents.List()
+	leased := make(map[string][]models.Task)
+	for _, task := range o.scheduler.Tasks() {
+		if task.Status == TaskStatusInProgress && task.AgentID != "" {
+			leased[task.AgentID] = append(leased[task.AgentID], task)
+		}
+	}
+	for i := range agents {
+		agents[i].Tasks = leased[agents[i].ID]
+		if agents[i].Tasks == nil {
+			agents[i].Tasks = []models.Task{}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]models.Agent{"agents": agents})
+}
+
+// requireAdmin пропускает только администраторов; остальным отвечает 401
+// или 403 и возвращает false.
+func (o *Orchestrator) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	user, ok := middleware.UserFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return false
+	}
+	if !o.isAdmin(user) {
+		writeJSONError(w, http.StatusForbidden, "Forbidden")
+		return false
+	}
+	return true
+}
+
+// isAdmin сообщает, входит ли пользователь в ADMIN_LOGINS.
+func (o *Orchestrator) isAdmin(user middleware.User) bool {
+	for _, login := range o.cfg.AdminLogins {
+		if user.Login == login {
+			return true
+		}
+	}
+	return false
+}
+
+// reapAgents возвращает в очередь задачи агентов, пропустивших heartbeat.
+// Как и просроченные аренды, упавшие агенты ищутся лениво — при обращении
+// агентов и администратора.
+func (o *Orchestrator) reapAgents() {
+	for _, id := range o.agents.Reap() {
+		n := o.scheduler.ReleaseAgent(id)
+		o.log.Error("Agent " + id + " missed heartbeats, " + strconv.Itoa(n) + " tasks re-queued")
+	}
+}
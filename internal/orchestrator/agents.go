@@ -0,0 +1,106 @@
+package orchestrator
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dimakirio/calculatorv1/internal/models"
+)
+
+var ErrAgentNotFound = errors.New("agent not found")
+
+// AgentRegistry хранит агентов, зарегистрированных у оркестратора, и время их
+// последнего heartbeat. Реестр живёт только в памяти: после перезапуска
+// оркестратора агенты регистрируются заново, получив 404 на heartbeat.
+type AgentRegistry struct {
+	mu        sync.Mutex
+	agents    map[string]*models.Agent
+	timeout   time.Duration // сколько агент может молчать, прежде чем считается упавшим
+	retention time.Duration // сколько упавший агент хранится в реестре
+	now       func() time.Time
+}
+
+// NewAgentRegistry создаёт реестр, в котором агент считается упавшим, если от
+// него не было heartbeat дольше timeout, и забывается ещё через retention.
+// Перезапущенный агент регистрируется под новым ID, поэтому без этого
+// упавшие агенты копились бы в реестре без конца.
+func NewAgentRegistry(timeout, retention time.Duration) *AgentRegistry {
+	return &AgentRegistry{
+		agents:    make(map[string]*models.Agent),
+		timeout:   timeout,
+		retention: retention,
+		now:       time.Now,
+	}
+}
+
+// Register добавляет агента или обновляет сведения о перезапущенном агенте с тем же ID.
+func (r *AgentRegistry) Register(id, hostname string, workers int) models.Agent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	agent := &models.Agent{
+		ID:           id,
+		Hostname:     hostname,
+		Workers:      workers,
+		Status:       models.AgentAlive,
+		RegisteredAt: now,
+		LastSeenAt:   now,
+	}
+	r.agents[id] = agent
+	return *agent
+}
+
+// Heartbeat отмечает, что агент жив. Агент, ранее признанный упавшим, снова
+// считается живым; его задачи к этому времени уже выданы другим агентам.
+func (r *AgentRegistry) Heartbeat(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agent, ok := r.agents[id]
+	if !ok {
+		return ErrAgentNotFound
+	}
+	agent.LastSeenAt = r.now()
+	agent.Status = models.AgentAlive
+	return nil
+}
+
+// Reap помечает упавшими агентов, пропустивших heartbeat, и возвращает ID
+// тех, кто перестал отвечать с прошлой проверки. Агенты, упавшие дольше
+// retention назад, удаляются из реестра; если такой агент всё же пришлёт
+// heartbeat, он получит 404 и зарегистрируется заново.
+func (r *AgentRegistry) Reap() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	var dead []string
+	for id, agent := range r.agents {
+		silent := now.Sub(agent.LastSeenAt)
+		if agent.Status == models.AgentAlive && silent > r.timeout {
+			agent.Status = models.AgentDead
+			dead = append(dead, id)
+		}
+		if agent.Status == models.AgentDead && silent > r.timeout+r.retention {
+			delete(r.agents, id)
+		}
+	}
+	sort.Strings(dead)
+	return dead
+}
+
+// List возвращает снимок реестра, упорядоченный по ID агента.
+func (r *AgentRegistry) List() []models.Agent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agents := make([]models.Agent, 0, len(r.agents))
+	for _, agent := range r.agents {
+		agents = append(agents, *agent)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+	return agents
+}
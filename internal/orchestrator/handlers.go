@@ -2,89 +2,402 @@ package orchestrator
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/dimakirio/calculatorv1/internal/calc"
 	"github.com/dimakirio/calculatorv1/internal/models"
 	"github.com/dimakirio/calculatorv1/pkg/config"
 	"github.com/dimakirio/calculatorv1/pkg/logger"
-	"github.com/Knetic/govaluate" // Импорт библиотеки для вычисления выражений
 	"github.com/google/uuid"
 	"github.com/dimakirio/calculatorv1/internal/auth"
-)
-
-var (
-	expressions = make(map[string]models.Expression)
-	mu          sync.Mutex
+	"github.com/dimakirio/calculatorv1/internal/middleware"
 )
 
 type Orchestrator struct {
-	log *logger.Logger
-	cfg *config.Config
+	log         *logger.Logger
+	cfg         *config.Config
+	users       *models.UserRepository
+	expressions *models.ExpressionRepository
+	scheduler   *Scheduler
+	agents      *AgentRegistry
+
+	// mu упорядочивает смену статусов выражений: каждая читает выражение,
+	// проверяет переход и сохраняет его целиком.
+	mu sync.Mutex
 }
 
-func NewOrchestrator(log *logger.Logger, cfg *config.Config) *Orchestrator {
-	return &Orchestrator{log: log, cfg: cfg}
+// NewOrchestrator создаёт оркестратор над общей базой db, открытой в main,
+// и продолжает вычисления, оставшиеся с прошлого запуска.
+func NewOrchestrator(log *logger.Logger, cfg *config.Config, db *models.Database) *Orchestrator {
+	o := &Orchestrator{
+		log:         log,
+		cfg:         cfg,
+		users:       models.NewUserRepository(db.DB()),
+		expressions: models.NewExpressionRepository(db.DB()),
+		agents: NewAgentRegistry(
+			time.Duration(cfg.AgentHeartbeatIntervalMS*cfg.AgentMissedHeartbeats)*time.Millisecond,
+			time.Duration(cfg.AgentDeadRetentionMS)*time.Millisecond,
+		),
+	}
+	o.scheduler = NewScheduler(cfg, log, models.NewTaskRepository(db.DB()), o.startExpression, o.completeExpression, o.failExpression)
+	if err := o.resume(); err != nil {
+		log.Fatal("Failed to resume expressions: " + err.Error())
+	}
+	return o
+}
+
+// resume продолжает вычисления, прерванные перезапуском: восстанавливает
+// сохранённые графы задач, а незаконченные выражения, для которых задач нет
+// (оркестратор упал до их сохранения или до сохранения результата),
+// раскладывает на задачи заново.
+func (o *Orchestrator) resume() error {
+	if err := o.scheduler.Restore(); err != nil {
+		return err
+	}
+	exprs, err := o.expressions.ListUnfinished()
+	if err != nil {
+		return err
+	}
+	restored := o.scheduler.Expressions()
+	for i := range exprs {
+		expr := &exprs[i]
+		if !restored[expr.ID] {
+			scheduled, err := o.replan(expr)
+			if err != nil {
+				return err
+			}
+			if !scheduled {
+				continue
+			}
+		}
+		// Выражение остаётся в pending, если оркестратор упал между
+		// сохранением графа и переводом в queued
+		if expr.Status == models.StatusPending {
+			o.queueRestored(expr)
+		}
+	}
+	return nil
+}
+
+// replan заново раскладывает на задачи выражение, у которого их нет, и
+// сообщает, появились ли у него задачи. Выражение без операций сразу
+// завершается, а непроверяемое пишется в лог и пропускается.
+func (o *Orchestrator) replan(expr *models.Expression) (bool, error) {
+	// Выражения, принятые до появления нынешних проверок, проверяются
+	// заново: ошибка в одном из них не должна мешать запуску.
+	mode := evalMode{Name: expr.Mode, Digits: expr.Digits, Scale: expr.Scale, Rounding: expr.Rounding}
+	root, err := parseExpression(expr.Expression)
+	if err == nil {
+		root, err = bindVariables(root, expr.Variables)
+	}
+	if err == nil {
+		err = checkMode(root, mode)
+	}
+	if err != nil {
+		o.log.Error("Failed to resume expression " + expr.ID + ": " + err.Error())
+		return false, nil
+	}
+	result, value, done, err := o.scheduler.AddExpression(expr.ID, root, mode)
+	if err != nil {
+		return false, err
+	}
+	if done {
+		o.completeExpression(expr.ID, result, value)
+		return false, nil
+	}
+	return true, nil
+}
+
+// queueRestored переводит восстановленное выражение из pending в queued.
+func (o *Orchestrator) queueRestored(expr *models.Expression) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.setStatus(expr, models.StatusQueued, time.Now(), nil)
 }
 
 func (o *Orchestrator) HandleCalculate(w http.ResponseWriter, r *http.Request) {
+	user, ok := middleware.UserFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
 	var req struct {
-		Expression string `json:"expression"`
+		Expression string                 `json:"expression"`
+		Variables  map[string]json.Number `json:"variables"`
+		Mode       string                 `json:"mode"`
+		Digits     *int                   `json:"digits"`
+		Scale      *int                   `json:"scale"`
+		Rounding   string                 `json:"rounding"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeJSONError(w, http.StatusUnprocessableEntity, "Invalid request body")
 		return
 	}
 
-	// Проверяем корректность выражения
-	if !isValidExpression(req.Expression) {
-		writeJSONError(w, http.StatusUnprocessableEntity, "Invalid expression")
+	mode, err := parseMode(req.Mode, req.Digits, req.Scale, req.Rounding)
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
 		return
 	}
 
-	// Вычисляем выражение
-	result, err := evaluateExpression(req.Expression)
+	// Разбираем выражение; синтаксическая ошибка возвращается с позицией
+	root, err := parseExpression(req.Expression)
+	if err == nil {
+		root, err = bindVariables(root, req.Variables)
+	}
+	if err == nil {
+		err = checkMode(root, mode)
+	}
 	if err != nil {
-		writeJSONError(w, http.StatusUnprocessableEntity, "Failed to evaluate expression")
+		writeSyntaxError(w, err)
 		return
 	}
 
 	id := uuid.New().String()
-	mu.Lock()
-	expressions[id] = models.Expression{
-		ID:     id,
-		Status: "completed",
-		Result: result,
+	err = o.expressions.Create(&models.Expression{
+		ID:         id,
+		UserID:     user.ID,
+		Expression: req.Expression,
+		Status:     models.StatusPending,
+		Variables:  req.Variables,
+		Mode:       mode.Name,
+		Digits:     mode.Digits,
+		Scale:      mode.Scale,
+		Rounding:   mode.Rounding,
+	})
+	if err != nil {
+		o.log.Error("Failed to save expression " + id + ": " + err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "Failed to save expression")
+		return
+	}
+
+	// Раскладываем выражение на задачи, которые будут вычислять агенты
+	result, value, done, err := o.scheduleExpression(id, root, mode)
+	if err != nil {
+		// Клиент получит ошибку, поэтому выражение не должно остаться в
+		// pending: иначе resume вычислит его после перезапуска
+		o.log.Error("Failed to schedule expression " + id + ": " + err.Error())
+		o.failExpression(id, models.TaskError{Code: models.ErrCodeScheduling, Message: "failed to schedule expression"})
+		writeJSONError(w, http.StatusInternalServerError, "Failed to schedule expression")
+		return
+	}
+	if done {
+		o.completeExpression(id, result, value)
 	}
-	mu.Unlock()
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"id": id})
 }
 
+// Размер страницы списка выражений.
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// HandleGetExpressions возвращает страницу выражений пользователя, отправившего запрос.
+// Параметры запроса: limit, cursor (next_cursor предыдущей страницы), status
+// (через запятую), created_from и created_to (RFC 3339), sort (created_at или
+// result) и order (asc или desc, по умолчанию desc — новые сначала).
 func (o *Orchestrator) HandleGetExpressions(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-	defer mu.Unlock()
+	user, ok := middleware.UserFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
 
-	var exprs []models.Expression
-	for _, expr := range expressions {
-		exprs = append(exprs, expr)
+	filter, err := parseExpressionFilter(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
 	}
+	filter.UserID = user.ID
 
+	page, err := o.expressions.ListPage(filter)
+	if errors.Is(err, models.ErrInvalidCursor) {
+		writeJSONError(w, http.StatusBadRequest, "Invalid cursor")
+		return
+	}
+	if err != nil {
+		o.log.Error("Failed to list expressions: " + err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load expressions")
+		return
+	}
+
+	// Пустая страница — пустой список, а не null
+	if page.Expressions == nil {
+		page.Expressions = []models.Expression{}
+	}
+	resp := map[string]interface{}{"expressions": page.Expressions, "total": page.Total}
+	if page.NextCursor != "" {
+		resp["next_cursor"] = page.NextCursor
+	}
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{"expressions": exprs})
+	json.NewEncoder(w).Encode(resp)
 }
 
-func (o *Orchestrator) HandleGetExpressionByID(w http.ResponseWriter, r *http.Request) {
+// parseExpressionFilter разбирает параметры запроса списка выражений
+func parseExpressionFilter(query url.Values) (models.ExpressionFilter, error) {
+	filter := models.ExpressionFilter{
+		Limit:      defaultPageLimit,
+		Cursor:     query.Get("cursor"),
+		Sort:       models.SortCreatedAt,
+		Descending: true,
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return filter, fmt.Errorf("limit must be an integer between 1 and %d", maxPageLimit)
+		}
+		filter.Limit = limit
+	}
+
+	if v := query.Get("status"); v != "" {
+		for _, s := range strings.Split(v, ",") {
+			status := models.ExpressionStatus(s)
+			if !status.Valid() {
+				return filter, fmt.Errorf("unknown status %q", s)
+			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+
+	for _, bound := range []struct {
+		name string
+		dst  *time.Time
+	}{{"created_from", &filter.CreatedFrom}, {"created_to", &filter.CreatedTo}} {
+		if v := query.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, fmt.Errorf("%s must be an RFC 3339 timestamp", bound.name)
+			}
+			*bound.dst = t
+		}
+	}
+
+	switch v := query.Get("sort"); v {
+	case "", models.SortCreatedAt, models.SortResult:
+		if v != "" {
+			filter.Sort = v
+		}
+	default:
+		return filter, fmt.Errorf("sort must be %s or %s", models.SortCreatedAt, models.SortResult)
+	}
+
+	switch query.Get("order") {
+	case "", "desc":
+	case "asc":
+		filter.Descending = false
+	default:
+		return filter, errors.New("order must be asc or desc")
+	}
+	return filter, nil
+}
+
+// HandleExpression обслуживает одно выражение пользователя:
+//
+//	GET    /api/v1/expressions/{id} — выражение;
+//	DELETE /api/v1/expressions/{id} — отмена вычисления.
+func (o *Orchestrator) HandleExpression(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		o.HandleGetExpressionByID(w, r)
+	case http.MethodDelete:
+		o.HandleCancelExpression(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// HandleCancelExpression отменяет вычисление выражения: снимает с очереди его
+// задачи, а результаты уже выданных агентам задач будут отброшены. Отвечает
+// итоговым состоянием выражения; повторная отмена не ошибка, а уже
+// вычисленное выражение отменить нельзя — 409.
+func (o *Orchestrator) HandleCancelExpression(w http.ResponseWriter, r *http.Request) {
+	user, ok := middleware.UserFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
 	id := r.URL.Path[len("/api/v1/expressions/"):]
-	mu.Lock()
-	expr, exists := expressions[id]
-	mu.Unlock()
+	o.mu.Lock()
+	defer o.mu.Unlock()
 
-	if !exists {
+	expr, err := o.expressions.GetByID(id)
+	if err == nil && expr.UserID != user.ID {
+		err = models.ErrExpressionNotFound
+	}
+	if errors.Is(err, models.ErrExpressionNotFound) {
 		writeJSONError(w, http.StatusNotFound, "Expression not found")
 		return
 	}
+	if err != nil {
+		o.log.Error("Failed to load expression " + id + ": " + err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load expression")
+		return
+	}
+
+	switch {
+	case expr.Status == models.StatusCancelled:
+	case expr.Status.Terminal():
+		writeJSONError(w, http.StatusConflict, "Expression is already "+string(expr.Status))
+		return
+	// Если у разложенного на задачи выражения задач не осталось, корневая
+	// задача уже вычислена и результат вот-вот будет сохранён
+	case !o.scheduler.CancelExpression(id) && expr.Status != models.StatusPending:
+		writeJSONError(w, http.StatusConflict, "Expression is already finished")
+		return
+	default:
+		if err := o.setStatus(expr, models.StatusCancelled, time.Now(), nil); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "Failed to cancel expression")
+			return
+		}
+		// Отвечаем сохранённым состоянием, как и GET
+		if expr, err = o.expressions.GetByID(id); err != nil {
+			o.log.Error("Failed to load expression " + id + ": " + err.Error())
+			writeJSONError(w, http.StatusInternalServerError, "Failed to load expression")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"expression": expr})
+}
+
+// HandleGetExpressionByID возвращает выражение по ID; чужие выражения
+// неотличимы от несуществующих
+func (o *Orchestrator) HandleGetExpressionByID(w http.ResponseWriter, r *http.Request) {
+	user, ok := middleware.UserFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	id := r.URL.Path[len("/api/v1/expressions/"):]
+	expr, err := o.expressions.GetByID(id)
+	if err == nil && expr.UserID != user.ID {
+		err = models.ErrExpressionNotFound
+	}
+	if errors.Is(err, models.ErrExpressionNotFound) {
+		writeJSONError(w, http.StatusNotFound, "Expression not found")
+		return
+	}
+	if err != nil {
+		o.log.Error("Failed to load expression " + id + ": " + err.Error())
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load expression")
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{"expression": expr})
@@ -107,14 +420,7 @@ func (o *Orchestrator) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusBadRequest, "Login and password required")
 		return
 	}
-	db, err := models.NewDatabase(o.cfg.DBPath)
-	if err != nil {
-		writeJSONError(w, http.StatusInternalServerError, "Database error")
-		return
-	}
-	defer db.Close()
-	repo := models.NewUserRepository(db.DB())
-	if err := repo.Create(req.Login, req.Password); err != nil {
+	if err := o.users.Create(req.Login, req.Password); err != nil {
 		writeJSONError(w, http.StatusBadRequest, err.Error())
 		return
 	}
@@ -135,15 +441,8 @@ func (o *Orchestrator) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, http.StatusUnprocessableEntity, "Invalid request body")
 		return
 	}
-	db, err := models.NewDatabase(o.cfg.DBPath)
-	if err != nil {
-		writeJSONError(w, http.StatusInternalServerError, "Database error")
-		return
-	}
-	defer db.Close()
-	repo := models.NewUserRepository(db.DB())
-	user, err := repo.GetByLogin(req.Login)
-	if err != nil || !repo.ValidatePassword(user, req.Password) {
+	user, err := o.users.GetByLogin(req.Login)
+	if err != nil || !o.users.ValidatePassword(user, req.Password) {
 		writeJSONError(w, http.StatusUnauthorized, "Invalid login or password")
 		return
 	}
@@ -157,38 +456,112 @@ func (o *Orchestrator) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"token": token})
 }
 
-// evaluateExpression вычисляет значение выражения
-func evaluateExpression(expression string) (float64, error) {
-	expr, err := govaluate.NewEvaluableExpression(expression)
-	if err != nil {
-		return 0, err
+// HandleGetFunctions возвращает список функций, доступных в выражениях
+func (o *Orchestrator) HandleGetFunctions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"functions": calc.Functions()})
+}
+
+// scheduleExpression раскладывает выражение на задачи и переводит его в
+// queued. Агент может получить задачу сразу после AddExpression, поэтому
+// статус меняется, не отпуская o.mu: иначе startExpression застанет
+// выражение в pending.
+func (o *Orchestrator) scheduleExpression(id string, root node, mode evalMode) (float64, string, bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	result, value, done, err := o.scheduler.AddExpression(id, root, mode)
+	if err == nil && !done {
+		o.queueExpression(id)
 	}
+	return result, value, done, err
+}
 
-	result, err := expr.Evaluate(nil)
+// queueExpression переводит только что разложенное на задачи выражение в
+// queued. Вызывающий держит o.mu.
+func (o *Orchestrator) queueExpression(id string) {
+	expr, err := o.expressions.GetByID(id)
 	if err != nil {
-		return 0, err
+		o.log.Error("Failed to load expression " + id + ": " + err.Error())
+		return
 	}
+	o.setStatus(expr, models.StatusQueued, time.Now(), nil)
+}
 
-	return result.(float64), nil
+// startExpression переводит выражение в in_progress, когда агент получает
+// первую его задачу; выдача следующих задач статус не меняет
+func (o *Orchestrator) startExpression(id string, at time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	expr, err := o.expressions.GetByID(id)
+	if err != nil {
+		o.log.Error("Failed to load expression " + id + ": " + err.Error())
+		return
+	}
+	if expr.Status == models.StatusInProgress {
+		return
+	}
+	o.setStatus(expr, models.StatusInProgress, at, nil)
 }
 
-// isValidExpression проверяет корректность выражения
-func isValidExpression(expression string) bool {
-	// Простая проверка на наличие некорректных символов
-	for _, char := range expression {
-		if !isValidCharacter(char) {
-			return false
+// completeExpression сохраняет результат вычисленного выражения
+func (o *Orchestrator) completeExpression(id string, result float64, value string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	expr, err := o.expressions.GetByID(id)
+	if err != nil {
+		o.log.Error("Failed to load expression " + id + ": " + err.Error())
+		return
+	}
+	o.setStatus(expr, models.StatusCompleted, time.Now(), func(expr *models.Expression) {
+		expr.Result = result
+		if expr.Mode != models.ModeFloat {
+			setExactResult(expr, value)
 		}
+	})
+}
+
+// failExpression помечает выражение как невычислимое и сохраняет ошибку задачи
+func (o *Orchestrator) failExpression(id string, taskErr models.TaskError) {
+	o.log.Error("Expression " + id + " failed: " + taskErr.Code + ": " + taskErr.Message)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	expr, err := o.expressions.GetByID(id)
+	if err != nil {
+		o.log.Error("Failed to load expression " + id + ": " + err.Error())
+		return
 	}
-	return true
+	o.setStatus(expr, models.StatusFailed, time.Now(), func(expr *models.Expression) {
+		expr.Error = &taskErr
+	})
 }
 
-// isValidCharacter проверяет, является ли символ допустимым
-func isValidCharacter(char rune) bool {
-	// Разрешенные символы: цифры, операторы (+,-,*,/), пробелы, скобки
-	return (char >= '0' && char <= '9') ||
-		char == '+' || char == '-' || char == '*' || char == '/' ||
-		char == ' ' || char == '(' || char == ')'
+// setStatus переводит выражение в статус to и сохраняет его; fill, если
+// задан, дописывает в выражение результат перехода. Переход, которого нет в
+// таблице переходов, отклоняется и пишется в лог как ошибка. Вызывающий
+// держит o.mu.
+func (o *Orchestrator) setStatus(expr *models.Expression, to models.ExpressionStatus, at time.Time, fill func(*models.Expression)) error {
+	if err := expr.Transition(to, at); err != nil {
+		o.log.Error("Rejected status change: " + err.Error())
+		return err
+	}
+	if fill != nil {
+		fill(expr)
+	}
+	if err := o.expressions.Update(expr); err != nil {
+		o.log.Error("Failed to save status of expression " + expr.ID + ": " + err.Error())
+		return err
+	}
+	return nil
 }
 
 func writeJSONError(w http.ResponseWriter, status int, message string) {
@@ -196,3 +569,19 @@ func writeJSONError(w http.ResponseWriter, status int, message string) {
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(map[string]string{"error": message})
 }
+
+// writeSyntaxError отвечает 422 с описанием ошибки разбора выражения:
+// {"error": "...", "syntax_error": {"offset", "token", "expected", "message"}}
+func writeSyntaxError(w http.ResponseWriter, err error) {
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":        syntaxErr.Message,
+		"syntax_error": syntaxErr,
+	})
+}
@@ -2,25 +2,76 @@ package orchestrator
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/dimakirio/calculatorv1/internal/calc"
+	"github.com/dimakirio/calculatorv1/internal/middleware"
 	"github.com/dimakirio/calculatorv1/internal/models"
 	"github.com/dimakirio/calculatorv1/pkg/config"
 	"github.com/dimakirio/calculatorv1/pkg/logger"
 )
 
-func TestHandleCalculate(t *testing.T) {
+// testConfig возвращает конфигурацию с отдельной базой данных для теста.
+func testConfig(t *testing.T) *config.Config {
 	cfg := config.LoadConfig()
+	cfg.DBPath = filepath.Join(t.TempDir(), "calc.db")
+	return cfg
+}
+
+// openTestDB открывает базу теста; соединения закрываются по завершении теста.
+func openTestDB(t *testing.T, cfg *config.Config) *models.Database {
+	t.Helper()
+	db, err := models.NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// testUserID — пользователь, от имени которого тесты отправляют выражения.
+const testUserID = 1
+
+// authRequest создаёт запрос от имени testUserID, как после AuthMiddleware.
+func authRequest(method, target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	return req.WithContext(middleware.WithUser(req.Context(), middleware.User{ID: testUserID, Login: "test"}))
+}
+
+// newAuthRequest — authRequest с сигнатурой http.NewRequest.
+func newAuthRequest(method, target string, body io.Reader) (*http.Request, error) {
+	return authRequest(method, target, body), nil
+}
+
+// getExpression читает сохранённое выражение по ID.
+func getExpression(t *testing.T, o *Orchestrator, id string) models.Expression {
+	t.Helper()
+	expr, err := o.expressions.GetByID(id)
+	if err != nil {
+		t.Fatalf("expression %s: %v", id, err)
+	}
+	return *expr
+}
+
+func TestHandleCalculate(t *testing.T) {
+	cfg := testConfig(t)
 	log := logger.NewLogger(cfg.LogLevel)
-	orchestrator := NewOrchestrator(log, cfg)
+	orchestrator := NewOrchestrator(log, cfg, openTestDB(t, cfg))
 
 	// Тест 1: Корректное выражение
 	reqBody := `{"expression": "2 + 2 * 2"}`
-	req, err := http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(reqBody))
+	req, err := newAuthRequest("POST", "/api/v1/calculate", bytes.NewBufferString(reqBody))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -44,7 +95,7 @@ func TestHandleCalculate(t *testing.T) {
 
 	// Тест 2: Некорректное выражение
 	reqBody = `{"expression": "2 + * 2"}`
-	req, err = http.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(reqBody))
+	req, err = newAuthRequest("POST", "/api/v1/calculate", bytes.NewBufferString(reqBody))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -58,14 +109,14 @@ func TestHandleCalculate(t *testing.T) {
 }
 
 func TestHandleGetExpressions(t *testing.T) {
-	cfg := config.LoadConfig()
+	cfg := testConfig(t)
 	log := logger.NewLogger(cfg.LogLevel)
-	orchestrator := NewOrchestrator(log, cfg)
+	orchestrator := NewOrchestrator(log, cfg, openTestDB(t, cfg))
 
 	// Добавляем тестовое выражение
-	orchestrator.HandleCalculate(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2 + 2"}`)))
+	orchestrator.HandleCalculate(httptest.NewRecorder(), authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2 + 2"}`)))
 
-	req, err := http.NewRequest("GET", "/api/v1/expressions", nil)
+	req, err := newAuthRequest("GET", "/api/v1/expressions", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -78,24 +129,123 @@ func TestHandleGetExpressions(t *testing.T) {
 		t.Errorf("Handler returned wrong status code: got %v, want %v", status, http.StatusOK)
 	}
 
-	var response map[string][]models.Expression
+	var response expressionList
 	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
 		t.Fatal(err)
 	}
 
-	if len(response["expressions"]) == 0 {
+	if len(response.Expressions) == 0 {
 		t.Errorf("Handler did not return any expressions")
 	}
 }
 
+// expressionList — ответ GET /api/v1/expressions.
+type expressionList struct {
+	Expressions []models.Expression `json:"expressions"`
+	Total       int                 `json:"total"`
+	NextCursor  string              `json:"next_cursor"`
+}
+
+func TestExpressionListPagination(t *testing.T) {
+	cfg := testConfig(t)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	calculate := func(expression string) {
+		rr := httptest.NewRecorder()
+		orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "`+expression+`"}`)))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("%s: expected 201, got %d", expression, rr.Code)
+		}
+	}
+	for _, e := range []string{"1 + 2", "0 + 1", "1 + 1", "1 / 0"} {
+		calculate(e)
+	}
+	runTasks(t, orchestrator)
+	calculate("5 + 5") // остаётся в очереди
+
+	list := func(query string) (expressionList, int) {
+		rr := httptest.NewRecorder()
+		orchestrator.HandleGetExpressions(rr, authRequest("GET", "/api/v1/expressions?"+query, nil))
+		var page expressionList
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return page, rr.Code
+	}
+	// all проходит все страницы и возвращает выражения в порядке выдачи
+	all := func(query string) []string {
+		var got []string
+		cursor := ""
+		for {
+			page, code := list(query + "&limit=2&cursor=" + cursor)
+			if code != http.StatusOK {
+				t.Fatalf("%s: expected 200, got %d", query, code)
+			}
+			if len(page.Expressions) > 2 {
+				t.Fatalf("%s: page larger than limit: %d", query, len(page.Expressions))
+			}
+			for _, e := range page.Expressions {
+				got = append(got, e.Expression)
+			}
+			if page.NextCursor == "" {
+				return got
+			}
+			cursor = page.NextCursor
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"5 + 5", "1 / 0", "1 + 1", "0 + 1", "1 + 2"}},
+		{"order=asc", []string{"1 + 2", "0 + 1", "1 + 1", "1 / 0", "5 + 5"}},
+		{"sort=result&order=asc", []string{"0 + 1", "1 + 1", "1 + 2", "1 / 0", "5 + 5"}},
+		{"sort=result", []string{"1 + 2", "1 + 1", "0 + 1", "5 + 5", "1 / 0"}},
+		{"status=completed,failed&sort=result", []string{"1 + 2", "1 + 1", "0 + 1", "1 / 0"}},
+		{"status=queued", []string{"5 + 5"}},
+		{"status=pending,in_progress", nil},
+		{"created_to=2000-01-01T00:00:00Z", nil},
+	}
+	for _, test := range tests {
+		got := all(test.query)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%q: expected %v, got %v", test.query, test.want, got)
+		}
+	}
+
+	// Пустая страница — пустой список, а не null
+	rr := httptest.NewRecorder()
+	orchestrator.HandleGetExpressions(rr, authRequest("GET", "/api/v1/expressions?status=cancelled", nil))
+	if body := strings.TrimSpace(rr.Body.String()); body != `{"expressions":[],"total":0}` {
+		t.Errorf("expected an empty list, got %s", body)
+	}
+
+	page, _ := list("limit=2&status=completed")
+	if page.Total != 3 || len(page.Expressions) != 2 || page.NextCursor == "" {
+		t.Errorf("expected first page of 3 completed expressions, got %+v", page)
+	}
+	if page, _ := list("created_from=2000-01-01T00:00:00Z"); page.Total != 5 {
+		t.Errorf("expected 5 expressions created after 2000, got %d", page.Total)
+	}
+
+	for _, query := range []string{"limit=0", "limit=501", "status=done", "cursor=%21%21", "cursor=bm9wZQ", "sort=id", "order=up", "created_from=yesterday"} {
+		if _, code := list(query); code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", query, code)
+		}
+	}
+}
+
 func TestHandleGetExpressionByID(t *testing.T) {
-	cfg := config.LoadConfig()
+	cfg := testConfig(t)
 	log := logger.NewLogger(cfg.LogLevel)
-	orchestrator := NewOrchestrator(log, cfg)
+	orchestrator := NewOrchestrator(log, cfg, openTestDB(t, cfg))
 
 	// Добавляем тестовое выражение
 	rr := httptest.NewRecorder()
-	orchestrator.HandleCalculate(rr, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2 + 2"}`)))
+	orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2 + 2"}`)))
 
 	var response map[string]string
 	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
@@ -103,7 +253,7 @@ func TestHandleGetExpressionByID(t *testing.T) {
 	}
 	id := response["id"]
 
-	req, err := http.NewRequest("GET", "/api/v1/expressions/"+id, nil)
+	req, err := newAuthRequest("GET", "/api/v1/expressions/"+id, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -126,6 +276,478 @@ func TestHandleGetExpressionByID(t *testing.T) {
 	}
 }
 
+func TestExpressionsScopedToOwner(t *testing.T) {
+	cfg := testConfig(t)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	rr := httptest.NewRecorder()
+	orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2 + 2"}`)))
+	var response map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if expr := getExpression(t, orchestrator, response["id"]); expr.UserID != testUserID {
+		t.Errorf("expected expression owned by user %d, got %d", testUserID, expr.UserID)
+	}
+
+	other := func(method, target string) *http.Request {
+		req := httptest.NewRequest(method, target, nil)
+		return req.WithContext(middleware.WithUser(req.Context(), middleware.User{ID: testUserID + 1, Login: "other"}))
+	}
+
+	rr = httptest.NewRecorder()
+	orchestrator.HandleGetExpressionByID(rr, other("GET", "/api/v1/expressions/"+response["id"]))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for another user's expression, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	orchestrator.HandleGetExpressions(rr, other("GET", "/api/v1/expressions"))
+	var list expressionList
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Expressions) != 0 || list.Total != 0 {
+		t.Errorf("expected no expressions for another user, got %+v", list)
+	}
+
+	// Без пользователя в контексте (маршрут не защищён middleware) — 401
+	rr = httptest.NewRecorder()
+	orchestrator.HandleCalculate(rr, httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2 + 2"}`)))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without user, got %d", rr.Code)
+	}
+}
+
+func TestExpressionDetails(t *testing.T) {
+	cfg := testConfig(t)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	rr := httptest.NewRecorder()
+	orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2 * 3"}`)))
+	var created map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	queued := getExpression(t, orchestrator, created["id"])
+	if queued.Status != models.StatusQueued {
+		t.Fatalf("expected queued expression, got %s", queued.Status)
+	}
+	if queued.CreatedAt.IsZero() || queued.StartedAt != nil || queued.FinishedAt != nil || queued.DurationMS != nil {
+		t.Fatalf("unexpected timestamps of a queued expression: %+v", queued)
+	}
+
+	task, _ := orchestrator.scheduler.NextTask("")
+	started := getExpression(t, orchestrator, created["id"])
+	if started.Status != models.StatusInProgress || started.StartedAt == nil || started.StartedAt.Before(started.CreatedAt) {
+		t.Fatalf("expected start time after leasing a task, got %+v", started)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := orchestrator.scheduler.CompleteTask(task.ID, task.LeaseID, 6, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	orchestrator.HandleGetExpressionByID(rr, authRequest("GET", "/api/v1/expressions/"+created["id"], nil))
+	var raw map[string]map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &raw); err != nil {
+		t.Fatal(err)
+	}
+	expr := raw["expression"]
+	for _, key := range []string{"id", "user_id", "expression", "status", "result", "mode", "error", "created_at", "started_at", "finished_at", "duration_ms"} {
+		if _, ok := expr[key]; !ok {
+			t.Errorf("expected key %q in %v", key, expr)
+		}
+	}
+	if expr["expression"] != "2 * 3" || expr["user_id"] != float64(testUserID) || expr["status"] != "completed" || expr["error"] != nil {
+		t.Errorf("unexpected expression: %v", expr)
+	}
+	if d, ok := expr["duration_ms"].(float64); !ok || d < 5 {
+		t.Errorf("expected duration of at least 5ms, got %v", expr["duration_ms"])
+	}
+
+	done := getExpression(t, orchestrator, created["id"])
+	var statuses []models.ExpressionStatus
+	for i, tr := range done.Transitions {
+		statuses = append(statuses, tr.Status)
+		if i > 0 && tr.At.Before(done.Transitions[i-1].At) {
+			t.Errorf("transitions out of order: %+v", done.Transitions)
+		}
+	}
+	if fmt.Sprint(statuses) != "[pending queued in_progress completed]" {
+		t.Errorf("unexpected transitions: %+v", done.Transitions)
+	}
+	if !done.Transitions[2].At.Equal(*done.StartedAt) || !done.Transitions[3].At.Equal(*done.FinishedAt) {
+		t.Errorf("transition times do not match start and finish: %+v", done)
+	}
+
+	// Результат уже вычисленного выражения не перезаписывается
+	orchestrator.failExpression(done.ID, models.TaskError{Code: "late", Message: "late failure"})
+	if expr := getExpression(t, orchestrator, done.ID); expr.Status != models.StatusCompleted || expr.Error != nil {
+		t.Errorf("expected completed expression to stay completed, got %+v", expr)
+	}
+}
+
+func TestCancelExpression(t *testing.T) {
+	cfg := testConfig(t)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	calculate := func(expression string) string {
+		rr := httptest.NewRecorder()
+		orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "`+expression+`"}`)))
+		var created map[string]string
+		if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+			t.Fatal(err)
+		}
+		return created["id"]
+	}
+	cancel := func(id string, userID int64) (models.Expression, int) {
+		req := httptest.NewRequest("DELETE", "/api/v1/expressions/"+id, nil)
+		req = req.WithContext(middleware.WithUser(req.Context(), middleware.User{ID: userID}))
+		rr := httptest.NewRecorder()
+		orchestrator.HandleExpression(rr, req)
+		var resp struct {
+			Expression models.Expression `json:"expression"`
+		}
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.Expression, rr.Code
+	}
+
+	id := calculate("(1 + 2) * (3 + 4)")
+	leased, _ := orchestrator.scheduler.NextTask("")
+
+	if _, code := cancel(id, testUserID+1); code != http.StatusNotFound {
+		t.Errorf("expected 404 for another user's expression, got %d", code)
+	}
+	expr, code := cancel(id, testUserID)
+	if code != http.StatusOK || expr.Status != models.StatusCancelled || expr.FinishedAt == nil {
+		t.Fatalf("expected cancelled expression, got %d %+v", code, expr)
+	}
+	if tasks := orchestrator.scheduler.Tasks(); len(tasks) != 0 {
+		t.Errorf("expected tasks to be withdrawn, got %+v", tasks)
+	}
+	if task, ok := orchestrator.scheduler.NextTask(""); ok {
+		t.Errorf("expected no tasks after cancellation, got %+v", task)
+	}
+
+	// Запоздавший результат выданной задачи принимается и отбрасывается
+	if err := orchestrator.scheduler.CompleteTask(leased.ID, leased.LeaseID, 3, ""); err != nil {
+		t.Errorf("expected late result to be discarded, got %v", err)
+	}
+	if expr := getExpression(t, orchestrator, id); expr.Status != models.StatusCancelled {
+		t.Errorf("expected expression to stay cancelled, got %s", expr.Status)
+	}
+
+	// Повторная отмена возвращает то же состояние
+	if again, code := cancel(id, testUserID); code != http.StatusOK || !again.FinishedAt.Equal(*expr.FinishedAt) {
+		t.Errorf("expected repeated cancellation to succeed, got %d %+v", code, again)
+	}
+
+	done := calculate("2 + 2")
+	runTasks(t, orchestrator)
+	if _, code := cancel(done, testUserID); code != http.StatusConflict {
+		t.Errorf("expected 409 for a completed expression, got %d", code)
+	}
+	if expr := getExpression(t, orchestrator, done); expr.Status != models.StatusCompleted || expr.Result != 4 {
+		t.Errorf("expected completed expression to be untouched, got %+v", expr)
+	}
+}
+
+func TestAgentHeartbeats(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AgentHeartbeatIntervalMS = 1000
+	cfg.AgentMissedHeartbeats = 3
+	cfg.AdminLogins = []string{"admin"}
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+	now := time.Now()
+	orchestrator.agents.now = func() time.Time { return now }
+
+	post := func(handler http.HandlerFunc, target, body string) int {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("POST", target, bytes.NewBufferString(body)))
+		return rr.Code
+	}
+	if code := post(orchestrator.HandleRegisterAgent, "/internal/agents", `{"id": "a1", "hostname": "host", "workers": 0}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 without workers, got %d", code)
+	}
+	if code := post(orchestrator.HandleRegisterAgent, "/internal/agents", `{"id": "a1", "hostname": "host", "workers": 2}`); code != http.StatusOK {
+		t.Fatalf("expected agent to register, got %d", code)
+	}
+	if code := post(orchestrator.HandleAgentHeartbeat, "/internal/agents/unknown/heartbeat", ""); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown agent, got %d", code)
+	}
+
+	rr := httptest.NewRecorder()
+	orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2 * 3"}`)))
+	rr = httptest.NewRecorder()
+	orchestrator.HandleInternalTask(rr, httptest.NewRequest("GET", "/internal/task?agent_id=a1", nil))
+	var task models.Task
+	if err := json.Unmarshal(rr.Body.Bytes(), &task); err != nil || task.AgentID != "a1" {
+		t.Fatalf("expected task leased to a1, got %+v (%v)", task, err)
+	}
+
+	listAgents := func(login string) ([]models.Agent, int) {
+		req := httptest.NewRequest("GET", "/api/v1/agents", nil)
+		req = req.WithContext(middleware.WithUser(req.Context(), middleware.User{ID: testUserID, Login: login}))
+		rr := httptest.NewRecorder()
+		orchestrator.HandleGetAgents(rr, req)
+		var resp map[string][]models.Agent
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp["agents"], rr.Code
+	}
+	if _, code := listAgents("test"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-admin user, got %d", code)
+	}
+	agents, _ := listAgents("admin")
+	if len(agents) != 1 || agents[0].Status != models.AgentAlive || len(agents[0].Tasks) != 1 || agents[0].Tasks[0].ID != task.ID {
+		t.Fatalf("expected alive agent a1 with its task, got %+v", agents)
+	}
+
+	// Heartbeat продлевает жизнь агента
+	now = now.Add(2 * time.Second)
+	if code := post(orchestrator.HandleAgentHeartbeat, "/internal/agents/a1/heartbeat", ""); code != http.StatusOK {
+		t.Fatalf("expected heartbeat to be accepted, got %d", code)
+	}
+	now = now.Add(2 * time.Second)
+	if agents, _ := listAgents("admin"); agents[0].Status != models.AgentAlive {
+		t.Fatalf("expected agent to stay alive after a heartbeat, got %+v", agents[0])
+	}
+
+	// Три пропущенных heartbeat — агент упал, его задача снова в очереди
+	now = now.Add(2 * time.Second)
+	agents, _ = listAgents("admin")
+	if agents[0].Status != models.AgentDead || len(agents[0].Tasks) != 0 {
+		t.Fatalf("expected dead agent without tasks, got %+v", agents[0])
+	}
+	again, ok := orchestrator.scheduler.NextTask("a2")
+	if !ok || again.ID != task.ID || again.Attempts != 2 {
+		t.Fatalf("expected task of the dead agent to be re-queued, got %+v", again)
+	}
+	if err := orchestrator.scheduler.CompleteTask(task.ID, task.LeaseID, 6, ""); !errors.Is(err, ErrLeaseMismatch) {
+		t.Errorf("expected result of the dead agent to be rejected, got %v", err)
+	}
+
+	// Вернувшийся агент снова считается живым
+	if code := post(orchestrator.HandleAgentHeartbeat, "/internal/agents/a1/heartbeat", ""); code != http.StatusOK {
+		t.Fatalf("expected heartbeat to be accepted, got %d", code)
+	}
+	if agents, _ := listAgents("admin"); agents[0].Status != models.AgentAlive {
+		t.Errorf("expected agent to be alive again, got %+v", agents[0])
+	}
+}
+
+func TestGetTasksRequiresAdmin(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AdminLogins = []string{"admin"}
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	rr := httptest.NewRecorder()
+	orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2 * 3"}`)))
+
+	listTasks := func(user *middleware.User) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/internal/tasks", nil)
+		if user != nil {
+			req = req.WithContext(middleware.WithUser(req.Context(), *user))
+		}
+		rr := httptest.NewRecorder()
+		orchestrator.HandleGetTasks(rr, req)
+		return rr
+	}
+	if rr := listTasks(nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a user, got %d", rr.Code)
+	}
+	if rr := listTasks(&middleware.User{ID: testUserID, Login: "test"}); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a non-admin user, got %d", rr.Code)
+	}
+	rr = listTasks(&middleware.User{ID: testUserID, Login: "admin"})
+	var resp map[string][]models.Task
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || rr.Code != http.StatusOK || len(resp["tasks"]) != 1 {
+		t.Errorf("expected admin to see 1 task, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestDeadAgentsEvicted(t *testing.T) {
+	registry := NewAgentRegistry(time.Second, time.Minute)
+	now := time.Now()
+	registry.now = func() time.Time { return now }
+	registry.Register("old", "host", 1)
+
+	// Упавший агент остаётся в списке, пока не истечёт срок хранения
+	now = now.Add(2 * time.Second)
+	if dead := registry.Reap(); len(dead) != 1 || dead[0] != "old" {
+		t.Fatalf("expected agent to be reaped, got %v", dead)
+	}
+	registry.Register("new", "host", 1)
+	if agents := registry.List(); len(agents) != 2 || agents[1].Status != models.AgentDead {
+		t.Fatalf("expected dead agent to be kept, got %+v", agents)
+	}
+
+	now = now.Add(time.Minute)
+	registry.Heartbeat("new")
+	registry.Reap()
+	if agents := registry.List(); len(agents) != 1 || agents[0].ID != "new" {
+		t.Fatalf("expected dead agent to be evicted, got %+v", agents)
+	}
+	if err := registry.Heartbeat("old"); !errors.Is(err, ErrAgentNotFound) {
+		t.Errorf("expected evicted agent to re-register, got %v", err)
+	}
+}
+
+func TestLongPollTask(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.TaskLongPollMaxMS = 5000
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	poll := func(query string) (*httptest.ResponseRecorder, time.Duration) {
+		start := time.Now()
+		rr := httptest.NewRecorder()
+		orchestrator.HandleInternalTask(rr, httptest.NewRequest("GET", "/internal/task?"+query, nil))
+		return rr, time.Since(start)
+	}
+
+	if rr, _ := poll("wait_ms=-1"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for negative wait, got %d", rr.Code)
+	}
+	if rr, elapsed := poll("wait_ms=50"); rr.Code != http.StatusNoContent || elapsed < 50*time.Millisecond {
+		t.Errorf("expected 204 after waiting 50ms, got %d after %v", rr.Code, elapsed)
+	}
+
+	// Задача, поставленная во время ожидания, выдаётся сразу
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rr, _ := poll("wait_ms=5000")
+		done <- rr
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2 * 3"}`)))
+	select {
+	case rr := <-done:
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected task, got %d", rr.Code)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("task picked up after %v", elapsed)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("long poll did not return the new task")
+	}
+
+	// Ожидание заканчивается, когда клиент закрывает соединение
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start = time.Now()
+	orchestrator.HandleInternalTask(httptest.NewRecorder(), httptest.NewRequest("GET", "/internal/task?wait_ms=5000", nil).WithContext(ctx))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("long poll outlived the request by %v", elapsed)
+	}
+}
+
+func TestTaskBatch(t *testing.T) {
+	cfg := testConfig(t)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	rr := httptest.NewRecorder()
+	orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "(1 + 2) * (3 + 4) * (5 + 6)"}`)))
+	var created map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range []string{"max=0", "max=x", "wait_ms=-1"} {
+		rr := httptest.NewRecorder()
+		orchestrator.HandleInternalTaskBatch(rr, httptest.NewRequest("GET", "/internal/task/batch?"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", query, rr.Code)
+		}
+	}
+
+	// Все три сложения готовы и выдаются одним пакетом
+	rr = httptest.NewRecorder()
+	orchestrator.HandleInternalTaskBatch(rr, httptest.NewRequest("GET", "/internal/task/batch?max=10", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var batch struct {
+		Tasks []models.Task `json:"tasks"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Tasks) != 3 {
+		t.Fatalf("expected 3 ready tasks, got %d", len(batch.Tasks))
+	}
+	if expr := getExpression(t, orchestrator, created["id"]); expr.Status != models.StatusInProgress {
+		t.Errorf("expected in_progress, got %s", expr.Status)
+	}
+
+	// Каждый результат подтверждается отдельно: неизвестная задача не мешает остальным
+	results := []map[string]interface{}{}
+	for _, task := range batch.Tasks {
+		results = append(results, map[string]interface{}{"id": task.ID, "lease_id": task.LeaseID, "result": task.Arg1 + task.Arg2})
+	}
+	results = append(results, map[string]interface{}{"id": "missing", "lease_id": "x", "result": 1})
+	body, _ := json.Marshal(map[string]interface{}{"results": results})
+	rr = httptest.NewRecorder()
+	orchestrator.HandleInternalTaskBatch(rr, httptest.NewRequest("POST", "/internal/task/batch", bytes.NewBuffer(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var acks struct {
+		Results []models.TaskAck `json:"results"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &acks); err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusNotFound}
+	if len(acks.Results) != len(expected) {
+		t.Fatalf("expected %d acknowledgements, got %+v", len(expected), acks.Results)
+	}
+	for i, ack := range acks.Results {
+		if ack.ID != results[i]["id"] || ack.Status != expected[i] {
+			t.Errorf("result %d: expected %d, got %+v", i, expected[i], ack)
+		}
+	}
+
+	// Результаты сверх TASK_BATCH_MAX отклоняются по одному, остальные применяются
+	cfg.TaskBatchMax = 1
+	rr = httptest.NewRecorder()
+	orchestrator.HandleInternalTaskBatch(rr, httptest.NewRequest("POST", "/internal/task/batch", bytes.NewBufferString(`{"results": [{"id": "a", "lease_id": "x", "result": 1}, {"id": "b", "lease_id": "x", "result": 1}]}`)))
+	acks.Results = nil
+	if err := json.Unmarshal(rr.Body.Bytes(), &acks); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(acks.Results) != 2 || acks.Results[0].Status != http.StatusNotFound || acks.Results[1].ID != "b" || acks.Results[1].Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected the result over the limit to be rejected with 413, got %+v", acks.Results)
+	}
+
+	for _, body := range []string{`{"results": []}`, `not json`} {
+		rr := httptest.NewRecorder()
+		orchestrator.HandleInternalTaskBatch(rr, httptest.NewRequest("POST", "/internal/task/batch", bytes.NewBufferString(body)))
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected 422 for %s, got %d", body, rr.Code)
+		}
+	}
+
+	runTasks(t, orchestrator)
+	if expr := getExpression(t, orchestrator, created["id"]); expr.Status != models.StatusCompleted || expr.Result != 231 {
+		t.Errorf("expected completed with 231, got %s %v", expr.Status, expr.Result)
+	}
+}
+
 func TestEvaluateExpression(t *testing.T) {
 	tests := []struct {
 		expression string
@@ -135,6 +757,58 @@ func TestEvaluateExpression(t *testing.T) {
 		{"2 + 2 * 2", 6, false},
 		{"(2 + 2) * 2", 8, false},
 		{"2 + * 2", 0, true}, // Некорректное выражение
+		{"1.5 * -2", -3, false},
+		{"3e8 / 2", 1.5e8, false},
+		{"2.5E-3 * 1000", 2.5, false},
+		{".5 + 1.", 0, true},
+		{".5 + 1.25", 1.75, false},
+		{"-(2+3)", -5, false},
+		{"+4 - +1", 3, false},
+		{"--2", 2, false},
+		{"2 * -(3 - 1)", -4, false},
+		{"1..2", 0, true},
+		{"1.2.3", 0, true},
+		{"1e", 0, true},
+		{"1e+", 0, true},
+		{"1e5e2", 0, true},
+		{"1e400", 0, true},
+		{".", 0, true},
+		{"2 ^ 3 ^ 2", 512, false},
+		{"-2 ^ 2", -4, false},
+		{"2 ^ -1", 0.5, false},
+		{"(2 ^ 3) ^ 2", 64, false},
+		{"7 % 3", 1, false},
+		{"-7 % 3", 2, false},
+		{"7 // 2", 3, false},
+		{"-7 // 2", -4, false},
+		{"2 + 7 // 2 * 3 % 4", 3, false},
+		{"1 + 2 ^ 2 * 3", 13, false},
+		{"2 ^", 0, true},
+		{"2 /// 2", 0, true},
+		{"sqrt(16) + abs(-3)", 7, false},
+		{"max(1, 2 * 5, 3) - min(4, -2)", 12, false},
+		{"round(2.5) + floor(-1.5) + ceil(1.2)", 3, false},
+		{"round(1.25, 1)", 1.3, false},
+		{"round(1250, -2)", 1300, false},
+		{"round(1.5, 400)", 1.5, false},
+		{"round(1e300, 10)", 1e300, false},
+		{"round(123, -400)", 0, false},
+		{"log2(8) * log(100) + ln(1) + sin(0)", 6, false},
+		{"sqrt(sqrt(81))", 3, false},
+		{"sqrt(-1)", 0, true},
+		{"ln(0)", 0, true},
+		{"asin(2)", 0, true},
+		{"log(8, 1)", 0, true},
+		{"sqrt(1, 2)", 0, true},
+		{"max()", 0, true},
+		{"foo(1)", 0, true},
+		{"sqrt 4", 0, true},
+		{"1 / 0", 0, true},
+		{"5 % 0", 0, true},
+		{"5 // (2 - 2)", 0, true},
+		{"0 ^ -1", 0, true},
+		{"1e308 * 10", 0, true},
+		{"(-8) ^ 0.5", 0, true},
 	}
 
 	for _, test := range tests {
@@ -154,6 +828,170 @@ func TestEvaluateExpression(t *testing.T) {
 	}
 }
 
+func TestExpressionsSurviveRestart(t *testing.T) {
+	cfg := testConfig(t)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	rr := httptest.NewRecorder()
+	orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "x * 2", "variables": {"x": 21}}`)))
+	var response map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, orchestrator)
+
+	// Новый оркестратор над той же базой видит вычисленное выражение
+	restarted := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+	expr := getExpression(t, restarted, response["id"])
+	if expr.Expression != "x * 2" || expr.Status != "completed" || expr.Result != 42 || expr.Variables["x"] != "21" {
+		t.Errorf("unexpected expression after restart: %+v", expr)
+	}
+}
+
+func TestTaskQueueSurvivesRestart(t *testing.T) {
+	cfg := testConfig(t)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	rr := httptest.NewRecorder()
+	orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "(1 + 2) * (3 + 4)"}`)))
+	var response map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	// Одна задача вычислена, вторая выдана агенту в момент остановки
+	first, _ := orchestrator.scheduler.NextTask("")
+	if err := orchestrator.scheduler.CompleteTask(first.ID, first.LeaseID, first.Arg1+first.Arg2, ""); err != nil {
+		t.Fatal(err)
+	}
+	leased, ok := orchestrator.scheduler.NextTask("")
+	if !ok {
+		t.Fatal("expected a second task")
+	}
+
+	restarted := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+	reissued, ok := restarted.scheduler.NextTask("")
+	if !ok || reissued.ID != leased.ID || reissued.LeaseID == leased.LeaseID || reissued.Attempts != 2 {
+		t.Fatalf("expected leased task %s to be re-issued, got %+v", leased.ID, reissued)
+	}
+	if err := restarted.scheduler.CompleteTask(leased.ID, leased.LeaseID, 7, ""); !errors.Is(err, ErrLeaseMismatch) {
+		t.Fatalf("expected result of the old lease to be rejected, got %v", err)
+	}
+	if err := restarted.scheduler.CompleteTask(reissued.ID, reissued.LeaseID, reissued.Arg1+reissued.Arg2, ""); err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, restarted)
+
+	expr := getExpression(t, restarted, response["id"])
+	if expr.Status != "completed" || expr.Result != 21 {
+		t.Errorf("expected completed expression with result 21, got %+v", expr)
+	}
+	if tasks := restarted.scheduler.Tasks(); len(tasks) != 0 {
+		t.Errorf("expected no tasks left, got %+v", tasks)
+	}
+}
+
+func TestResumePendingExpressionWithoutTasks(t *testing.T) {
+	cfg := testConfig(t)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	// Выражение сохранено, но оркестратор остановился раньше, чем сохранил его задачи
+	err := orchestrator.expressions.Create(&models.Expression{
+		ID:         "interrupted",
+		Expression: "x / 4",
+		Status:     models.StatusPending,
+		Variables:  map[string]json.Number{"x": "1"},
+		Mode:       models.ModeExact,
+		Digits:     5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+	runTasks(t, restarted)
+	expr := getExpression(t, restarted, "interrupted")
+	if expr.Status != "completed" || expr.ResultFraction != "1/4" || expr.ResultDecimal != "0.25000" {
+		t.Errorf("expected resumed expression to complete with 1/4, got %+v", expr)
+	}
+}
+
+func TestResumePendingExpressionWithTasks(t *testing.T) {
+	cfg := testConfig(t)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	// Задачи выражения сохранены, но оркестратор остановился раньше, чем перевёл его в queued
+	err := orchestrator.expressions.Create(&models.Expression{
+		ID:         "interrupted",
+		Expression: "2 * 3",
+		Status:     models.StatusPending,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := parseExpression("2 * 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := orchestrator.scheduler.AddExpression("interrupted", root, evalMode{Name: models.ModeFloat}); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+	if expr := getExpression(t, restarted, "interrupted"); expr.Status != models.StatusQueued {
+		t.Fatalf("expected restored expression to be queued, got %s", expr.Status)
+	}
+	runTasks(t, restarted)
+	if expr := getExpression(t, restarted, "interrupted"); expr.Status != models.StatusCompleted || expr.Result != 6 {
+		t.Errorf("expected resumed expression to complete with 6, got %+v", expr)
+	}
+}
+
+func TestScheduleFailure(t *testing.T) {
+	cfg := testConfig(t)
+	db := openTestDB(t, cfg)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, db)
+
+	// Без таблицы задач граф выражения не сохранить
+	if _, err := db.DB().Exec("DROP TABLE tasks"); err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2 * 3"}`)))
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", rr.Code)
+	}
+
+	page, err := orchestrator.expressions.ListPage(models.ExpressionFilter{UserID: testUserID, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Expressions) != 1 || page.Expressions[0].Status != models.StatusFailed || page.Expressions[0].Error == nil || page.Expressions[0].Error.Code != models.ErrCodeScheduling {
+		t.Errorf("expected failed expression with %s, got %+v", models.ErrCodeScheduling, page.Expressions)
+	}
+}
+
+func TestResumeSkipsInvalidExpression(t *testing.T) {
+	cfg := testConfig(t)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	// Выражение сохранено до появления проверки чисел точного режима
+	err := orchestrator.expressions.Create(&models.Expression{
+		ID:         "invalid",
+		Expression: "1e-10000000 + 1",
+		Status:     models.StatusPending,
+		Mode:       models.ModeExact,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+	if restarted.scheduler.Expressions()["invalid"] {
+		t.Error("expected invalid expression not to be scheduled")
+	}
+}
+
 func TestRegisterAndLogin(t *testing.T) {
 	// Удаляем тестовую БД перед запуском
 	_ = os.Remove("test.db")
@@ -162,7 +1000,7 @@ func TestRegisterAndLogin(t *testing.T) {
 		JWTSecret: "testsecret",
 	}
 	log := logger.NewLogger("info")
-	o := NewOrchestrator(log, cfg)
+	o := NewOrchestrator(log, cfg, openTestDB(t, cfg))
 
 	// Регистрация
 	registerBody := `{"login":"testuser","password":"testpass"}`
@@ -191,3 +1029,589 @@ func TestRegisterAndLogin(t *testing.T) {
 		t.Fatalf("no token in response")
 	}
 }
+
+func TestExpressionDispatch(t *testing.T) {
+	cfg := testConfig(t)
+	log := logger.NewLogger(cfg.LogLevel)
+	orchestrator := NewOrchestrator(log, cfg, openTestDB(t, cfg))
+
+	rr := httptest.NewRecorder()
+	orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "(2 + 3) * (10 - 4) / 2"}`)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+	var response map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	id := response["id"]
+
+	// Независимые задачи выдаются одновременно, зависимые — после их результатов
+	first, ok := orchestrator.scheduler.NextTask("")
+	if !ok {
+		t.Fatal("expected a ready task")
+	}
+	second, ok := orchestrator.scheduler.NextTask("")
+	if !ok {
+		t.Fatal("expected a second ready task")
+	}
+	if _, ok := orchestrator.scheduler.NextTask(""); ok {
+		t.Fatal("dependent task must not be ready before its arguments")
+	}
+
+	pending := []models.Task{first, second}
+	for len(pending) > 0 {
+		task := pending[0]
+		pending = pending[1:]
+		var result float64
+		switch task.Operation {
+		case "+":
+			result = task.Arg1 + task.Arg2
+		case "-":
+			result = task.Arg1 - task.Arg2
+		case "*":
+			result = task.Arg1 * task.Arg2
+		case "/":
+			result = task.Arg1 / task.Arg2
+		}
+		if err := orchestrator.scheduler.CompleteTask(task.ID, task.LeaseID, result, ""); err != nil {
+			t.Fatalf("complete task: %v", err)
+		}
+		for {
+			next, ok := orchestrator.scheduler.NextTask("")
+			if !ok {
+				break
+			}
+			pending = append(pending, next)
+		}
+	}
+
+	expr := getExpression(t, orchestrator, id)
+	if expr.Status != "completed" || expr.Result != 15 {
+		t.Errorf("expected completed expression with result 15, got %+v", expr)
+	}
+}
+
+func TestHandleInternalTask(t *testing.T) {
+	cfg := testConfig(t)
+	log := logger.NewLogger(cfg.LogLevel)
+	orchestrator := NewOrchestrator(log, cfg, openTestDB(t, cfg))
+	handler := http.HandlerFunc(orchestrator.HandleInternalTask)
+
+	// Нет работы — 204
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/internal/task", nil))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+
+	orchestrator.HandleCalculate(httptest.NewRecorder(), authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "6 / 3"}`)))
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/internal/task", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var task models.Task
+	if err := json.Unmarshal(rr.Body.Bytes(), &task); err != nil {
+		t.Fatal(err)
+	}
+	if task.Operation != "/" || task.Arg1 != 6 || task.Arg2 != 3 || task.LeaseID == "" || task.LeaseExpiresAt.IsZero() {
+		t.Fatalf("unexpected task: %+v", task)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"invalid json", `{`, http.StatusUnprocessableEntity},
+		{"missing result", `{"id": "` + task.ID + `", "lease_id": "` + task.LeaseID + `"}`, http.StatusUnprocessableEntity},
+		{"missing lease", `{"id": "` + task.ID + `", "result": 2}`, http.StatusUnprocessableEntity},
+		{"unknown task", `{"id": "nope", "lease_id": "nope", "result": 2}`, http.StatusNotFound},
+		{"wrong lease", `{"id": "` + task.ID + `", "lease_id": "nope", "result": 2}`, http.StatusConflict},
+		{"result and error", `{"id": "` + task.ID + `", "lease_id": "` + task.LeaseID + `", "result": 2, "error": {"code": "boom"}}`, http.StatusUnprocessableEntity},
+		{"accepted", `{"id": "` + task.ID + `", "lease_id": "` + task.LeaseID + `", "result": 2}`, http.StatusOK},
+		{"already completed", `{"id": "` + task.ID + `", "lease_id": "` + task.LeaseID + `", "result": 2}`, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/internal/task", bytes.NewBufferString(test.body)))
+		if rr.Code != test.status {
+			t.Errorf("%s: expected %d, got %d, body: %s", test.name, test.status, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.TaskLeaseTimeoutMS = 1000
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+	now := time.Now()
+	orchestrator.scheduler.now = func() time.Time { return now }
+
+	rr := httptest.NewRecorder()
+	orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "6 / 3"}`)))
+	var created map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	first, ok := orchestrator.scheduler.NextTask("")
+	if !ok || first.Attempts != 1 || !first.LeaseExpiresAt.Equal(now.Add(time.Second)) {
+		t.Fatalf("unexpected first lease: %+v", first)
+	}
+	if _, ok := orchestrator.scheduler.NextTask(""); ok {
+		t.Fatal("leased task must not be handed out again before its lease expires")
+	}
+
+	// Агент пропал: после истечения аренды задача выдаётся повторно.
+	now = now.Add(2 * time.Second)
+	second, ok := orchestrator.scheduler.NextTask("")
+	if !ok || second.ID != first.ID || second.LeaseID == first.LeaseID || second.Attempts != 2 {
+		t.Fatalf("expected task %s to be redelivered, got %+v", first.ID, second)
+	}
+	tasks := orchestrator.scheduler.Tasks()
+	if len(tasks) != 1 || tasks[0].Attempts != 2 || tasks[0].Status != TaskStatusInProgress {
+		t.Fatalf("unexpected tasks snapshot: %+v", tasks)
+	}
+
+	// Опоздавший результат по старой аренде отклоняется.
+	if err := orchestrator.scheduler.CompleteTask(first.ID, first.LeaseID, 2, ""); !errors.Is(err, ErrLeaseMismatch) {
+		t.Fatalf("expected ErrLeaseMismatch for stale lease, got %v", err)
+	}
+
+	// Результат после истечения текущей аренды тоже отклоняется, задача снова в очереди.
+	now = now.Add(2 * time.Second)
+	if err := orchestrator.scheduler.CompleteTask(second.ID, second.LeaseID, 2, ""); !errors.Is(err, ErrLeaseExpired) {
+		t.Fatalf("expected ErrLeaseExpired, got %v", err)
+	}
+	third, ok := orchestrator.scheduler.NextTask("")
+	if !ok || third.ID != first.ID || third.Attempts != 3 {
+		t.Fatalf("expected third delivery, got %+v", third)
+	}
+	if err := orchestrator.scheduler.CompleteTask(third.ID, third.LeaseID, 2, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	expr := getExpression(t, orchestrator, created["id"])
+	if expr.Status != "completed" || expr.Result != 2 {
+		t.Fatalf("expected expression to complete after redelivery, got %+v", expr)
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		offset     int
+		token      string
+		expected   string
+	}{
+		{"2 + * 2", 4, "*", "number"},
+		{"", 0, "", "number"},
+		{"(2 + 2", 6, "", ")"},
+		{"2 + 2)", 5, ")", "end of expression"},
+		{"2 # 2", 2, "#", "operator"},
+		{"2 2", 2, "2", "operator"},
+		{"2 + ж", 4, "ж", "number"},
+		{"1..2", 2, ".", "digit"},
+		{"1.2.3", 3, ".", "operator"},
+		{"3e+ 1", 3, " ", "digit"},
+		{"1e", 2, "", "digit"},
+		{"2 * . 1", 4, ".", "digit"},
+		{"max(1 2)", 6, "2", ","},
+		{"sqrt(4", 6, "", ")"},
+		{"sqrt 4", 5, "4", "operator"},
+	}
+
+	for _, test := range tests {
+		_, err := parseExpression(test.expression)
+		syntaxErr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("Expected *SyntaxError for expression: %q, got: %v", test.expression, err)
+			continue
+		}
+		if syntaxErr.Offset != test.offset || syntaxErr.Token != test.token {
+			t.Errorf("For expression: %q, expected offset %d token %q, got offset %d token %q",
+				test.expression, test.offset, test.token, syntaxErr.Offset, syntaxErr.Token)
+		}
+		found := false
+		for _, e := range syntaxErr.Expected {
+			found = found || e == test.expected
+		}
+		if !found {
+			t.Errorf("For expression: %q, expected hint %q in %v", test.expression, test.expected, syntaxErr.Expected)
+		}
+	}
+
+	// Ошибка возвращается клиенту в теле ответа 422
+	cfg := testConfig(t)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+	rr := httptest.NewRecorder()
+	orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2 + * 2"}`)))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", rr.Code)
+	}
+	var response struct {
+		Error       string       `json:"error"`
+		SyntaxError *SyntaxError `json:"syntax_error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Error == "" || response.SyntaxError == nil || response.SyntaxError.Offset != 4 || response.SyntaxError.Token != "*" {
+		t.Errorf("unexpected 422 body: %s", rr.Body.String())
+	}
+}
+
+func TestTaskFailure(t *testing.T) {
+	cfg := testConfig(t)
+	log := logger.NewLogger(cfg.LogLevel)
+	orchestrator := NewOrchestrator(log, cfg, openTestDB(t, cfg))
+
+	rr := httptest.NewRecorder()
+	orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "(1 + 2) * (3 + 4)"}`)))
+	var response map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	task, ok := orchestrator.scheduler.NextTask("")
+	if !ok {
+		t.Fatal("expected a ready task")
+	}
+	body := `{"id": "` + task.ID + `", "lease_id": "` + task.LeaseID + `", "error": {"code": "unknown_operation", "message": "unknown operation"}}`
+	rr = httptest.NewRecorder()
+	orchestrator.HandleInternalTask(rr, httptest.NewRequest("POST", "/internal/task", bytes.NewBufferString(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+
+	// Остальные задачи выражения сняты с очереди
+	if next, ok := orchestrator.scheduler.NextTask(""); ok {
+		t.Errorf("expected no tasks after failure, got %+v", next)
+	}
+	expr := getExpression(t, orchestrator, response["id"])
+	if expr.Status != "failed" || expr.Error == nil || expr.Error.Code != models.ErrCodeUnknownOperation {
+		t.Errorf("expected failed expression with unknown_operation error, got %+v", expr)
+	}
+}
+
+func TestHandleGetFunctions(t *testing.T) {
+	cfg := testConfig(t)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	rr := httptest.NewRecorder()
+	orchestrator.HandleGetFunctions(rr, httptest.NewRequest("GET", "/api/v1/functions", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	var response map[string][]calc.Function
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, f := range response["functions"] {
+		if f.Name == "sqrt" && f.MinArgs == 1 && f.MaxArgs == 1 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("sqrt not listed in %s", rr.Body.String())
+	}
+}
+
+func TestVariables(t *testing.T) {
+	vars := map[string]json.Number{"price": "250", "qty": "4", "discount": "0.1"}
+	if result, err := evaluateExpressionWith("price * qty * (1 - discount)", vars); err != nil || result != 900 {
+		t.Errorf("expected 900, got %v (%v)", result, err)
+	}
+
+	_, err := evaluateExpressionWith("price * qty", map[string]json.Number{"price": "1"})
+	if syntaxErr, ok := err.(*SyntaxError); !ok || syntaxErr.Offset != 8 || syntaxErr.Token != "qty" {
+		t.Errorf("expected unbound variable error at offset 8, got %v", err)
+	}
+	if _, err := evaluateExpressionWith("price * 2", map[string]json.Number{"price": "1", "qyt": "2"}); err == nil {
+		t.Error("expected error for unused variable")
+	}
+
+	cfg := testConfig(t)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	rr := httptest.NewRecorder()
+	orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(
+		`{"expression": "price * qty", "variables": {"price": 2.5, "qty": 4}}`)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d, body: %s", rr.Code, rr.Body.String())
+	}
+	var response map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	expr := getExpression(t, orchestrator, response["id"])
+	if expr.Variables["price"] != "2.5" || expr.Variables["qty"] != "4" {
+		t.Errorf("variables not stored with expression: %+v", expr)
+	}
+
+	for _, body := range []string{
+		`{"expression": "price * qty", "variables": {"price": 2.5}}`,
+		`{"expression": "price * 2", "variables": {"price": 2.5, "qty": 4}}`,
+		// В режиме float число должно помещаться в float64
+		`{"expression": "price * 2", "variables": {"price": 1e400}}`,
+		`{"expression": "1e400 / 1e399"}`,
+	} {
+		rr = httptest.NewRecorder()
+		orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(body)))
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected 422 for %s, got %d", body, rr.Code)
+		}
+	}
+}
+
+// evaluateExpression вычисляет значение выражения на месте, без агентов и
+// планировщика: тесты сверяют с ним разбор и семантику операций.
+func evaluateExpression(expression string) (float64, error) {
+	return evaluateExpressionWith(expression, nil)
+}
+
+// evaluateExpressionWith вычисляет выражение с заданными значениями переменных
+func evaluateExpressionWith(expression string, variables map[string]json.Number) (float64, error) {
+	root, err := parseExpression(expression)
+	if err != nil {
+		return 0, err
+	}
+	root, err = bindVariables(root, variables)
+	if err == nil {
+		err = checkMode(root, evalMode{Name: models.ModeFloat})
+	}
+	if err != nil {
+		return 0, err
+	}
+	return evaluateNode(root)
+}
+
+// evaluateNode рекурсивно вычисляет значение узла AST
+func evaluateNode(n node) (float64, error) {
+	switch n := n.(type) {
+	case *numberNode:
+		return n.value, nil
+	case *unaryNode:
+		value, err := evaluateNode(n.operand)
+		if n.op == "-" {
+			value = -value
+		}
+		return value, err
+	case *binaryNode:
+		left, err := evaluateNode(n.left)
+		if err != nil {
+			return 0, err
+		}
+		right, err := evaluateNode(n.right)
+		if err != nil {
+			return 0, err
+		}
+		return calc.Apply(n.op, left, right)
+	case *callNode:
+		args := make([]float64, len(n.args))
+		for i, a := range n.args {
+			value, err := evaluateNode(a)
+			if err != nil {
+				return 0, err
+			}
+			args[i] = value
+		}
+		return calc.Call(n.name, args)
+	}
+	return 0, fmt.Errorf("unexpected node %T", n)
+}
+
+// runTasks вычисляет все задачи планировщика так же, как это сделал бы агент.
+func runTasks(t *testing.T, o *Orchestrator) {
+	t.Helper()
+	for {
+		task, ok := o.scheduler.NextTask("")
+		if !ok {
+			return
+		}
+		var err error
+		if task.Mode != "" {
+			execute := calc.ExecuteExact
+			if task.Mode == models.ModeDecimal {
+				execute = calc.ExecuteDecimal
+			}
+			value, calcErr := execute(&task)
+			if calcErr != nil {
+				err = o.scheduler.FailTask(task.ID, task.LeaseID, *calc.TaskError(calcErr))
+			} else {
+				err = o.scheduler.CompleteTask(task.ID, task.LeaseID, 0, value)
+			}
+		} else {
+			result, calcErr := calc.Execute(&task)
+			if calcErr != nil {
+				err = o.scheduler.FailTask(task.ID, task.LeaseID, *calc.TaskError(calcErr))
+			} else {
+				err = o.scheduler.CompleteTask(task.ID, task.LeaseID, result, "")
+			}
+		}
+		if err != nil {
+			t.Fatalf("task %s: %v", task.ID, err)
+		}
+	}
+}
+
+func TestExactMode(t *testing.T) {
+	cfg := testConfig(t)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	tests := []struct {
+		body     string
+		fraction string
+		decimal  string
+	}{
+		{`{"expression": "0.1 + 0.2", "mode": "exact", "digits": 5}`, "3/10", "0.30000"},
+		{`{"expression": "1 / 3 + 1 / 6", "mode": "exact"}`, "1/2", "0.50000000000000000000"},
+		{`{"expression": "2 / 3", "mode": "exact", "digits": 4}`, "2/3", "0.6667"},
+		{`{"expression": "-(1/3) * 3 ^ 2 - 7 // 2 + abs(-1e-3)", "mode": "exact", "digits": 3}`, "-5999/1000", "-5.999"},
+		{`{"expression": "x * 3", "variables": {"x": 0.1}, "mode": "exact", "digits": 1}`, "3/10", "0.3"},
+		{`{"expression": "0.5", "mode": "exact", "digits": 2}`, "1/2", "0.50"},
+		// Числа вне диапазона float64 допустимы в точном режиме
+		{`{"expression": "1e400 / 1e399", "mode": "exact", "digits": 0}`, "10", "10"},
+		{`{"expression": "x / 1e399", "variables": {"x": 1e400}, "mode": "exact", "digits": 0}`, "10", "10"},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(test.body)))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("%s: expected 201, got %d, body: %s", test.body, rr.Code, rr.Body.String())
+		}
+		var response map[string]string
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		runTasks(t, orchestrator)
+
+		expr := getExpression(t, orchestrator, response["id"])
+		if expr.Status != "completed" || expr.ResultFraction != test.fraction || expr.ResultDecimal != test.decimal {
+			t.Errorf("%s: expected %s = %s, got %+v", test.body, test.fraction, test.decimal, expr)
+		}
+	}
+
+	for _, body := range []string{
+		`{"expression": "sqrt(2)", "mode": "exact"}`,
+		`{"expression": "1 + 1", "mode": "fuzzy"}`,
+		`{"expression": "1 + 1", "mode": "exact", "digits": -1}`,
+		// float64 разбирает такие числа как 0, big.Rat — не разбирает
+		`{"expression": "1e-10000000", "mode": "exact"}`,
+		`{"expression": "x", "variables": {"x": 1e-10000000}, "mode": "exact"}`,
+		// Знаменатель ~3.3 млн бит — длиннее допустимого в точном режиме
+		`{"expression": "1e-999999", "mode": "exact"}`,
+		`{"expression": "x + 1", "variables": {"x": 1e-999999}, "mode": "exact"}`,
+	} {
+		rr := httptest.NewRecorder()
+		orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(body)))
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: expected 422, got %d", body, rr.Code)
+		}
+	}
+}
+
+func TestDecimalMode(t *testing.T) {
+	cfg := testConfig(t)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	tests := []struct {
+		body    string
+		decimal string
+	}{
+		// Округление применяется к каждой операции: 10/3 = 3.33, 3.33*3 = 9.99
+		{`{"expression": "10 / 3 * 3", "mode": "decimal"}`, "9.99"},
+		{`{"expression": "0.125 + 0", "mode": "decimal", "rounding": "half_even"}`, "0.12"},
+		{`{"expression": "0.135 + 0", "mode": "decimal", "rounding": "half_even"}`, "0.14"},
+		{`{"expression": "0.125 + 0", "mode": "decimal", "rounding": "half_up"}`, "0.13"},
+		{`{"expression": "-0.125 + 0", "mode": "decimal", "rounding": "half_up"}`, "-0.13"},
+		{`{"expression": "0.129 + 0", "mode": "decimal", "rounding": "down"}`, "0.12"},
+		{`{"expression": "-0.129 + 0", "mode": "decimal", "rounding": "down"}`, "-0.12"},
+		{`{"expression": "1.005", "mode": "decimal", "rounding": "half_up"}`, "1.01"},
+		{`{"expression": "2 / 3", "mode": "decimal", "scale": 4}`, "0.6667"},
+		{`{"expression": "7 / 2", "mode": "decimal", "scale": 0}`, "4"},
+		{`{"expression": "0.1 + 0.2", "mode": "decimal", "scale": 20}`, "0.30000000000000000000"},
+		{`{"expression": "price * qty * (1 - discount)", "variables": {"price": 19.99, "qty": 3, "discount": 0.15}, "mode": "decimal"}`, "50.97"},
+		{`{"expression": "1e400 / 1e399", "mode": "decimal"}`, "10.00"},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(test.body)))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("%s: expected 201, got %d, body: %s", test.body, rr.Code, rr.Body.String())
+		}
+		var response map[string]string
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		runTasks(t, orchestrator)
+
+		expr := getExpression(t, orchestrator, response["id"])
+		if expr.Status != "completed" || expr.ResultDecimal != test.decimal {
+			t.Errorf("%s: expected %s, got %+v", test.body, test.decimal, expr)
+		}
+	}
+
+	for _, body := range []string{
+		`{"expression": "1 + 1", "mode": "decimal", "rounding": "up"}`,
+		`{"expression": "1 + 1", "mode": "decimal", "scale": 101}`,
+		`{"expression": "sqrt(4)", "mode": "decimal"}`,
+		`{"expression": "1e-10000000 + 1", "mode": "decimal"}`,
+		`{"expression": "1e-999999", "mode": "decimal"}`,
+		`{"expression": "x * 2", "variables": {"x": 1e-999999}, "mode": "decimal"}`,
+	} {
+		rr := httptest.NewRecorder()
+		orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(body)))
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: expected 422, got %d", body, rr.Code)
+		}
+	}
+}
+
+func TestArithmeticFaults(t *testing.T) {
+	cfg := testConfig(t)
+	orchestrator := NewOrchestrator(logger.NewLogger(cfg.LogLevel), cfg, openTestDB(t, cfg))
+
+	tests := []struct {
+		body string
+		code string
+	}{
+		{`{"expression": "1 / (2 - 2)"}`, models.ErrCodeDivisionByZero},
+		{`{"expression": "1e308 * 10"}`, models.ErrCodeNonFinite},
+		{`{"expression": "sqrt(1 - 2)"}`, models.ErrCodeDomain},
+		{`{"expression": "1 / (1 - 1)", "mode": "exact"}`, models.ErrCodeDivisionByZero},
+		{`{"expression": "2 % 0", "mode": "decimal"}`, models.ErrCodeDivisionByZero},
+		// Показатель в пределах ограничения, но результат занял бы ~1e12 бит
+		{`{"expression": "((2 ^ 10000) ^ 10000) ^ 10000", "mode": "exact"}`, models.ErrCodeDomain},
+		{`{"expression": "(3 ^ 10000) ^ 10000 * 0", "mode": "decimal"}`, models.ErrCodeDomain},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		orchestrator.HandleCalculate(rr, authRequest("POST", "/api/v1/calculate", bytes.NewBufferString(test.body)))
+		var response map[string]string
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		runTasks(t, orchestrator)
+
+		// Ошибка видна через GET и ответ остаётся корректным JSON
+		rr = httptest.NewRecorder()
+		orchestrator.HandleGetExpressionByID(rr, authRequest("GET", "/api/v1/expressions/"+response["id"], nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", test.body, rr.Code)
+		}
+		var got map[string]models.Expression
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: invalid json %q: %v", test.body, rr.Body.String(), err)
+		}
+		expr := got["expression"]
+		if expr.Status != "failed" || expr.Error == nil || expr.Error.Code != test.code || expr.Error.Message == "" {
+			t.Errorf("%s: expected failed expression with %s, got %+v", test.body, test.code, expr)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package orchestrator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenIdent
+	tokenInvalid // нераспознанный символ, используется только в ошибках
+)
+
+// token — лексема выражения; Offset — смещение в байтах от начала строки.
+type token struct {
+	Kind   tokenKind
+	Text   string
+	Offset int
+}
+
+// SyntaxError описывает ошибку разбора выражения так, чтобы клиент мог
+// подсветить конкретное место: смещение в байтах, сам токен и что ожидалось.
+type SyntaxError struct {
+	Offset   int      `json:"offset"`
+	Token    string   `json:"token"`
+	Expected []string `json:"expected,omitempty"`
+	Message  string   `json:"message"`
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Message
+}
+
+// newSyntaxError формирует ошибку «неожиданный токен» с подсказкой об ожидаемых.
+func newSyntaxError(tok token, expected ...string) *SyntaxError {
+	var msg string
+	if tok.Kind == tokenEOF {
+		msg = fmt.Sprintf("unexpected end of expression at offset %d", tok.Offset)
+	} else {
+		msg = fmt.Sprintf("unexpected %q at offset %d", tok.Text, tok.Offset)
+	}
+	if len(expected) > 0 {
+		msg += ", expected " + joinExpected(expected)
+	}
+	return &SyntaxError{Offset: tok.Offset, Token: tok.Text, Expected: expected, Message: msg}
+}
+
+// joinExpected перечисляет ожидаемые токены для сообщения; знаки берутся в кавычки.
+func joinExpected(expected []string) string {
+	quoted := make([]string, len(expected))
+	for i, e := range expected {
+		if utf8.RuneCountInString(e) == 1 {
+			e = strconv.Quote(e)
+		}
+		quoted[i] = e
+	}
+	if len(quoted) == 1 {
+		return quoted[0]
+	}
+	return strings.Join(quoted[:len(quoted)-1], ", ") + " or " + quoted[len(quoted)-1]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+// scanNumber читает числовой литерал, начинающийся с input[start], и
+// возвращает смещение его конца. Допустимые формы: 12, 1.5, .5, 3e8, 2.5E-3.
+func scanNumber(input string, start int) (int, error) {
+	i := start
+	digits := func() int {
+		n := 0
+		for i < len(input) && isDigit(input[i]) {
+			i++
+			n++
+		}
+		return n
+	}
+	// unexpected возвращает ошибку о символе в позиции i (или о конце строки).
+	unexpected := func(expected ...string) error {
+		tok := token{Kind: tokenEOF, Offset: i}
+		if i < len(input) {
+			r, _ := utf8.DecodeRuneInString(input[i:])
+			tok = token{Kind: tokenInvalid, Text: string(r), Offset: i}
+		}
+		return newSyntaxError(tok, expected...)
+	}
+
+	intDigits := digits()
+	if i < len(input) && input[i] == '.' {
+		i++
+		if digits() == 0 {
+			if intDigits == 0 {
+				i = start
+			}
+			return 0, unexpected("digit")
+		}
+	}
+	if i < len(input) && (input[i] == 'e' || input[i] == 'E') {
+		i++
+		if i < len(input) && (input[i] == '+' || input[i] == '-') {
+			i++
+		}
+		if digits() == 0 {
+			return 0, unexpected("digit")
+		}
+	}
+	// Число не может сразу продолжаться точкой или ещё одной экспонентой: 1.2.3, 1e2e3
+	if i < len(input) && (input[i] == '.' || input[i] == 'e' || input[i] == 'E') {
+		return 0, unexpected("operator", ")", "end of expression")
+	}
+	return i, nil
+}
+
+// tokenize разбивает выражение на лексемы. Пробелы игнорируются, любой
+// неизвестный символ — синтаксическая ошибка.
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isDigit(c) || c == '.':
+			end, err := scanNumber(input, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{Kind: tokenNumber, Text: input[i:end], Offset: i})
+			i = end
+		case c == '/' && i+1 < len(input) && input[i+1] == '/':
+			tokens = append(tokens, token{Kind: tokenOperator, Text: "//", Offset: i})
+			i += 2
+		case c == '+' || c == '-' || c == '*' || c == '/' || c == '^' || c == '%':
+			tokens = append(tokens, token{Kind: tokenOperator, Text: string(c), Offset: i})
+			i++
+		case isLetter(c):
+			start := i
+			for i < len(input) && (isLetter(input[i]) || isDigit(input[i])) {
+				i++
+			}
+			tokens = append(tokens, token{Kind: tokenIdent, Text: input[start:i], Offset: start})
+		case c == ',':
+			tokens = append(tokens, token{Kind: tokenComma, Text: ",", Offset: i})
+			i++
+		case c == '(':
+			tokens = append(tokens, token{Kind: tokenLParen, Text: "(", Offset: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{Kind: tokenRParen, Text: ")", Offset: i})
+			i++
+		default:
+			r, _ := utf8.DecodeRuneInString(input[i:])
+			return nil, newSyntaxError(token{Kind: tokenInvalid, Text: string(r), Offset: i}, "number", "identifier", "operator", "(", ")")
+		}
+	}
+	tokens = append(tokens, token{Kind: tokenEOF, Offset: len(input)})
+	return tokens, nil
+}
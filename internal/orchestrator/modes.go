@@ -0,0 +1,179 @@
+package orchestrator
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/dimakirio/calculatorv1/internal/calc"
+	"github.com/dimakirio/calculatorv1/internal/models"
+)
+
+// Число знаков после запятой в десятичной записи точного результата и
+// масштаб десятичного режима.
+const (
+	defaultExactDigits = 20
+	maxExactDigits     = 1000
+	defaultScale       = 2
+	maxScale           = 100
+)
+
+// evalMode — режим вычисления выражения с его параметрами.
+type evalMode struct {
+	Name     string // models.ModeFloat, models.ModeExact или models.ModeDecimal
+	Digits   int    // знаков в десятичной записи результата точного режима
+	Scale    int    // знаков после запятой в десятичном режиме
+	Rounding string // способ округления в десятичном режиме
+}
+
+// exact сообщает, что значения режима передаются строками, а не float64.
+func (m evalMode) exact() bool {
+	return m.Name != models.ModeFloat
+}
+
+// parseMode проверяет режим вычисления и его параметры из запроса; пустой
+// режим означает вычисления в float64.
+func parseMode(name string, digits, scale *int, rounding string) (evalMode, error) {
+	switch name {
+	case "", models.ModeFloat:
+		return evalMode{Name: models.ModeFloat}, nil
+	case models.ModeExact:
+		m := evalMode{Name: name, Digits: defaultExactDigits}
+		if digits != nil {
+			if *digits < 0 || *digits > maxExactDigits {
+				return evalMode{}, fmt.Errorf("digits must be between 0 and %d", maxExactDigits)
+			}
+			m.Digits = *digits
+		}
+		return m, nil
+	case models.ModeDecimal:
+		m := evalMode{Name: name, Scale: defaultScale, Rounding: models.RoundHalfEven}
+		if scale != nil {
+			if *scale < 0 || *scale > maxScale {
+				return evalMode{}, fmt.Errorf("scale must be between 0 and %d", maxScale)
+			}
+			m.Scale = *scale
+		}
+		if rounding != "" {
+			if !calc.IsRoundingMode(rounding) {
+				return evalMode{}, fmt.Errorf("unknown rounding mode %q", rounding)
+			}
+			m.Rounding = rounding
+		}
+		return m, nil
+	default:
+		return evalMode{}, fmt.Errorf("unknown mode %q", name)
+	}
+}
+
+// setExactResult заполняет результат выражения точного или десятичного
+// режима. В точном режиме это несократимая дробь и десятичная запись с
+// expr.Digits знаками, в десятичном — запись с expr.Scale знаками.
+// Result в обоих случаях хранит приближение float64.
+func setExactResult(expr *models.Expression, value string) {
+	r, err := calc.ParseRat(value)
+	if err != nil {
+		return
+	}
+	expr.Result, _ = r.Float64()
+	if expr.Mode == models.ModeDecimal {
+		expr.ResultDecimal = calc.RoundDecimal(r, expr.Scale, expr.Rounding)
+		return
+	}
+	expr.ResultFraction = r.RatString()
+	expr.ResultDecimal = r.FloatString(expr.Digits)
+}
+
+// checkMode проверяет, что выражение вычислимо в выбранном режиме: в точном
+// и десятичном режимах допустимы только функции с рациональным результатом и
+// числа, представимые дробью (лексер пропускает, например, 1e-10000000 —
+// float64 округляет его до нуля, а big.Rat не разбирает) не длиннее
+// calc.MaxExactBits: агент такие числа всё равно отклонит, а оркестратор
+// успел бы потратить время и место на их запись.
+func checkMode(n node, mode evalMode) error {
+	switch n := n.(type) {
+	case *numberNode:
+		if !mode.exact() && math.IsInf(n.value, 0) {
+			return &SyntaxError{
+				Offset:  n.pos,
+				Token:   n.text,
+				Message: fmt.Sprintf("number %s is out of range in %s mode at offset %d", n.text, mode.Name, n.pos),
+			}
+		}
+		if mode.exact() {
+			r, err := calc.ParseRat(n.text)
+			if err != nil {
+				return &SyntaxError{
+					Offset:  n.pos,
+					Token:   n.text,
+					Message: fmt.Sprintf("number %s is out of range in %s mode at offset %d", n.text, mode.Name, n.pos),
+				}
+			}
+			if !calc.FitsExact(r) {
+				return &SyntaxError{
+					Offset:  n.pos,
+					Token:   n.text,
+					Message: fmt.Sprintf("number %s is longer than %d bits in %s mode at offset %d", n.text, calc.MaxExactBits, mode.Name, n.pos),
+				}
+			}
+		}
+	case *unaryNode:
+		return checkMode(n.operand, mode)
+	case *binaryNode:
+		if err := checkMode(n.left, mode); err != nil {
+			return err
+		}
+		return checkMode(n.right, mode)
+	case *callNode:
+		if mode.exact() && !calc.SupportsExact(n.name) {
+			return &SyntaxError{
+				Offset:  n.pos,
+				Token:   n.name,
+				Message: fmt.Sprintf("function %q is not supported in %s mode at offset %d", n.name, mode.Name, n.pos),
+			}
+		}
+		for _, arg := range n.args {
+			if err := checkMode(arg, mode); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// literal возвращает значение числа в виде операнда выбранного режима.
+func literal(n *numberNode, mode evalMode) (operand, error) {
+	if mode.exact() {
+		r, err := calc.ParseRat(n.text)
+		if err != nil {
+			return operand{}, err
+		}
+		return operand{text: r.RatString()}, nil
+	}
+	return operand{value: n.value}, nil
+}
+
+// negate меняет знак известного операнда.
+func negate(op operand, mode evalMode) (operand, error) {
+	if mode.exact() {
+		r, err := calc.ParseRat(op.text)
+		if err != nil {
+			return operand{}, err
+		}
+		return operand{text: r.Neg(r).RatString()}, nil
+	}
+	return operand{value: -op.value}, nil
+}
+
+// checkResult проверяет, что результат агента записан в форме режима задачи.
+func checkResult(mode, value string) error {
+	if mode == "" {
+		if value != "" {
+			return ErrInvalidResult
+		}
+		return nil
+	}
+	if _, err := calc.ParseRat(value); err != nil {
+		return ErrInvalidResult
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/dimakirio/calculatorv1/internal/calc"
+)
+
+// node — узел абстрактного синтаксического дерева выражения.
+type node interface {
+	offset() int
+}
+
+type numberNode struct {
+	value float64
+	text  string // исходная запись числа, из которой точный режим берёт значение без потерь
+	pos   int
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+	pos     int
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+	pos         int
+}
+
+type variableNode struct {
+	name string
+	pos  int
+}
+
+type callNode struct {
+	name string
+	args []node
+	pos  int
+}
+
+func (n *numberNode) offset() int   { return n.pos }
+func (n *unaryNode) offset() int    { return n.pos }
+func (n *binaryNode) offset() int   { return n.pos }
+func (n *variableNode) offset() int { return n.pos }
+func (n *callNode) offset() int     { return n.pos }
+
+// parser — рекурсивный спуск по грамматике:
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/" | "//" | "%") unary }
+//	unary   = ("+" | "-") unary | power
+//	power   = primary [ "^" unary ]
+//	primary = number | call | ident | "(" expr ")"
+//	call    = ident "(" [ expr { "," expr } ] ")"
+//
+// Степень правоассоциативна и связывает сильнее унарного минуса:
+// 2^3^2 = 2^(3^2), -2^2 = -(2^2), 2^-1 = 0.5.
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parseExpression строит AST выражения или возвращает *SyntaxError.
+func parseExpression(input string) (node, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.Kind != tokenEOF {
+		return nil, newSyntaxError(tok, "operator", "end of expression")
+	}
+	return root, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.Kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) parseExpr() (node, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		if tok.Kind != tokenOperator || (tok.Text != "+" && tok.Text != "-") {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: tok.Text, left: left, right: right, pos: tok.Offset}
+	}
+}
+
+func (p *parser) parseTerm() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		if tok.Kind != tokenOperator || (tok.Text != "*" && tok.Text != "/" && tok.Text != "//" && tok.Text != "%") {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: tok.Text, left: left, right: right, pos: tok.Offset}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if tok := p.peek(); tok.Kind == tokenOperator && (tok.Text == "-" || tok.Text == "+") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: tok.Text, operand: operand, pos: tok.Offset}, nil
+	}
+	return p.parsePower()
+}
+
+func (p *parser) parsePower() (node, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	if tok.Kind != tokenOperator || tok.Text != "^" {
+		return base, nil
+	}
+	p.next()
+	exponent, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return &binaryNode{op: tok.Text, left: base, right: exponent, pos: tok.Offset}, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.next()
+	switch tok.Kind {
+	case tokenNumber:
+		// Число вне диапазона float64 (1e400) допустимо в точном и десятичном
+		// режимах, в режиме float его отклоняет checkMode
+		value, err := strconv.ParseFloat(tok.Text, 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return nil, &SyntaxError{
+				Offset:  tok.Offset,
+				Token:   tok.Text,
+				Message: fmt.Sprintf("invalid number %q at offset %d", tok.Text, tok.Offset),
+			}
+		}
+		return &numberNode{value: value, text: tok.Text, pos: tok.Offset}, nil
+	case tokenIdent:
+		if p.peek().Kind != tokenLParen {
+			return &variableNode{name: tok.Text, pos: tok.Offset}, nil
+		}
+		return p.parseCall(tok)
+	case tokenLParen:
+		inner, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.Kind != tokenRParen {
+			return nil, newSyntaxError(closing, "operator", ")")
+		}
+		return inner, nil
+	default:
+		return nil, newSyntaxError(tok, "number", "variable", "function", "(", "-", "+")
+	}
+}
+
+// parseCall разбирает вызов функции из белого списка calc и проверяет число аргументов.
+func (p *parser) parseCall(name token) (node, error) {
+	fn, ok := calc.LookupFunction(name.Text)
+	if !ok {
+		return nil, &SyntaxError{
+			Offset:  name.Offset,
+			Token:   name.Text,
+			Message: fmt.Sprintf("unknown function %q at offset %d", name.Text, name.Offset),
+		}
+	}
+	p.next() // "("
+
+	call := &callNode{name: name.Text, pos: name.Offset}
+	if p.peek().Kind == tokenRParen {
+		p.next()
+	} else {
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+
+			tok := p.next()
+			if tok.Kind == tokenRParen {
+				break
+			}
+			if tok.Kind != tokenComma {
+				return nil, newSyntaxError(tok, "operator", ",", ")")
+			}
+		}
+	}
+
+	if err := fn.CheckArity(len(call.args)); err != nil {
+		return nil, &SyntaxError{
+			Offset:  name.Offset,
+			Token:   name.Text,
+			Message: fmt.Sprintf("%s at offset %d", err.Error(), name.Offset),
+		}
+	}
+	return call, nil
+}
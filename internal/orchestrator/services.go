@@ -1,3 +1,590 @@
 package orchestrator
 
 // Services содержит логику для обработки выражений и задач.
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dimakirio/calculatorv1/internal/models"
+	"github.com/dimakirio/calculatorv1/pkg/config"
+	"github.com/dimakirio/calculatorv1/pkg/logger"
+	"github.com/google/uuid"
+)
+
+// Статусы задач в графе выражения.
+const (
+	TaskStatusWaiting    = "waiting"     // ждёт результатов зависимых задач
+	TaskStatusReady      = "ready"       // все аргументы известны, задача в очереди
+	TaskStatusInProgress = "in_progress" // задача выдана агенту
+	TaskStatusCompleted  = "completed"
+)
+
+var (
+	ErrTaskNotFound      = errors.New("task not found")
+	ErrTaskNotInProgress = errors.New("task is not in progress")
+	ErrLeaseMismatch     = errors.New("lease does not match the current task lease")
+	ErrLeaseExpired      = errors.New("task lease has expired")
+	ErrInvalidResult     = errors.New("result does not match the task mode")
+)
+
+// taskNode — узел графа задач. Результат узла подставляется в аргумент
+// родительской задачи, а результат корневого узла — это результат выражения.
+type taskNode struct {
+	task    models.Task
+	exprID  string
+	parent  *taskNode
+	slot    int // номер аргумента родителя (с нуля), который заполняет этот узел
+	waiting int // число ещё не вычисленных аргументов
+}
+
+// setArg подставляет значение i-го аргумента: в точных режимах это Values[i],
+// у функций — Args[i], у бинарных операций — Arg1 или Arg2.
+func (n *taskNode) setArg(i int, value float64, text string) {
+	switch {
+	case n.task.Values != nil:
+		n.task.Values[i] = text
+	case n.task.Args != nil:
+		n.task.Args[i] = value
+	case i == 0:
+		n.task.Arg1 = value
+	default:
+		n.task.Arg2 = value
+	}
+}
+
+// record — состояние узла для сохранения в базе.
+func (n *taskNode) record() *models.TaskRecord {
+	rec := &models.TaskRecord{Task: n.task, ExpressionID: n.exprID, Slot: n.slot, Waiting: n.waiting}
+	if n.parent != nil {
+		rec.ParentID = n.parent.task.ID
+	}
+	return rec
+}
+
+// operand — аргумент задачи при построении графа: либо известное значение
+// (value в режиме float, text в точных режимах), либо задача-зависимость.
+type operand struct {
+	value float64
+	text  string
+	node  *taskNode
+}
+
+// Scheduler хранит графы задач всех выражений и раздаёт готовые задачи агентам.
+// Каждое изменение графа записывается в таблицу tasks, чтобы после перезапуска
+// оркестратора вычисления продолжились с того же места (см. Restore).
+type Scheduler struct {
+	cfg   *config.Config
+	log   *logger.Logger
+	tasks *models.TaskRepository
+	mu    sync.Mutex
+	nodes map[string]*taskNode
+	ready []*taskNode
+	// leases — выданные агентам задачи; по ним ищутся просроченные аренды.
+	leases map[string]*taskNode
+	// cancelled — выданные агентам задачи отменённых выражений. Результат по
+	// ним принимается и отбрасывается, пока не истечёт аренда.
+	cancelled map[string]*taskNode
+	now       func() time.Time
+	// wake закрывается и заменяется новым каналом, когда в очереди
+	// появляются задачи; на нём ждут агенты с длинным опросом.
+	wake chan struct{}
+
+	// onStart вызывается при каждой выдаче задачи выражения агенту,
+	// onComplete — когда вычислена корневая задача выражения,
+	// onFail — когда агент не смог вычислить одну из задач выражения.
+	// В точных режимах результат передаётся строкой в value.
+	onStart    func(exprID string, at time.Time)
+	onComplete func(exprID string, result float64, value string)
+	onFail     func(exprID string, taskErr models.TaskError)
+}
+
+func NewScheduler(cfg *config.Config, log *logger.Logger, tasks *models.TaskRepository, onStart func(exprID string, at time.Time), onComplete func(exprID string, result float64, value string), onFail func(exprID string, taskErr models.TaskError)) *Scheduler {
+	return &Scheduler{
+		cfg:        cfg,
+		log:        log,
+		tasks:      tasks,
+		nodes:      make(map[string]*taskNode),
+		leases:     make(map[string]*taskNode),
+		cancelled:  make(map[string]*taskNode),
+		wake:       make(chan struct{}),
+		now:        time.Now,
+		onStart:    onStart,
+		onComplete: onComplete,
+		onFail:     onFail,
+	}
+}
+
+// AddExpression раскладывает AST выражения в граф задач режима mode и ставит
+// в очередь те из них, у которых все аргументы уже известны. Если в выражении
+// нет ни одной операции, его значение возвращается сразу с done == true.
+// Граф сохраняется в базе до того, как задачи станут доступны агентам.
+func (s *Scheduler) AddExpression(exprID string, root node, mode evalMode) (float64, string, bool, error) {
+	var nodes []*taskNode
+	top, err := s.plan(exprID, root, mode, &nodes)
+	if err != nil {
+		return 0, "", false, err
+	}
+	if top.node == nil {
+		return top.value, top.text, true, nil
+	}
+
+	records := make([]models.TaskRecord, len(nodes))
+	for i, n := range nodes {
+		if n.waiting == 0 {
+			n.task.Status = TaskStatusReady
+		}
+		records[i] = *n.record()
+	}
+	if err := s.tasks.CreateGraph(records); err != nil {
+		return 0, "", false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range nodes {
+		s.nodes[n.task.ID] = n
+		if n.waiting == 0 {
+			s.ready = append(s.ready, n)
+		}
+	}
+	s.signal()
+	return 0, "", false, nil
+}
+
+// Restore загружает из базы графы задач, оставшиеся с прошлого запуска.
+// Задачи, которые были выданы агентам, снова ставятся в очередь: аренды
+// прошлого запуска не сохраняются, и результат по ним будет отклонён.
+func (s *Scheduler) Restore() error {
+	records, err := s.tasks.List()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nodes := make([]*taskNode, len(records))
+	for i, rec := range records {
+		nodes[i] = &taskNode{task: rec.Task, exprID: rec.ExpressionID, slot: rec.Slot, waiting: rec.Waiting}
+		s.nodes[rec.Task.ID] = nodes[i]
+	}
+	for i, rec := range records {
+		n := nodes[i]
+		if rec.ParentID != "" {
+			n.parent = s.nodes[rec.ParentID]
+		}
+		switch n.task.Status {
+		case TaskStatusInProgress:
+			s.release(n)
+			n.task.Status = TaskStatusReady
+			s.save(n)
+			s.ready = append(s.ready, n)
+		case TaskStatusReady:
+			s.ready = append(s.ready, n)
+		}
+	}
+	return nil
+}
+
+// Expressions возвращает множество выражений, у которых есть задачи в графе.
+func (s *Scheduler) Expressions() map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exprs := make(map[string]bool)
+	for _, n := range s.nodes {
+		exprs[n.exprID] = true
+	}
+	return exprs
+}
+
+// save записывает состояние задачи в базу. Граф в памяти остаётся главным,
+// поэтому ошибка записи только логируется. Вызывается под s.mu.
+func (s *Scheduler) save(n *taskNode) {
+	if err := s.tasks.Save(n.record()); err != nil {
+		s.log.Error("Failed to save task " + n.task.ID + ": " + err.Error())
+	}
+}
+
+// plan рекурсивно создаёт задачи для поддерева и возвращает операнд, которым
+// поддерево станет для родителя: число или задачу, чей результат нужно дождаться.
+func (s *Scheduler) plan(exprID string, root node, mode evalMode, nodes *[]*taskNode) (operand, error) {
+	var task models.Task
+	var args []operand
+	switch n := root.(type) {
+	case *numberNode:
+		return literal(n, mode)
+	case *unaryNode:
+		if n.op == "+" {
+			return s.plan(exprID, n.operand, mode, nodes)
+		}
+		// Унарный минус над числом — это просто отрицательное число,
+		// над подвыражением он сводится к вычитанию из нуля.
+		arg, err := s.plan(exprID, n.operand, mode, nodes)
+		if err != nil {
+			return operand{}, err
+		}
+		if arg.node == nil {
+			return negate(arg, mode)
+		}
+		zero, err := literal(&numberNode{text: "0"}, mode)
+		if err != nil {
+			return operand{}, err
+		}
+		task.Operation = models.OpSubtract
+		args = []operand{zero, arg}
+	case *binaryNode:
+		task.Operation = n.op
+		for _, a := range []node{n.left, n.right} {
+			arg, err := s.plan(exprID, a, mode, nodes)
+			if err != nil {
+				return operand{}, err
+			}
+			args = append(args, arg)
+		}
+	case *callNode:
+		task.Operation = n.name
+		for _, a := range n.args {
+			arg, err := s.plan(exprID, a, mode, nodes)
+			if err != nil {
+				return operand{}, err
+			}
+			args = append(args, arg)
+		}
+	}
+
+	if mode.exact() {
+		task.Mode = mode.Name
+		task.Scale = mode.Scale
+		task.Rounding = mode.Rounding
+		task.Values = make([]string, len(args))
+	} else if _, ok := root.(*callNode); ok {
+		task.Args = make([]float64, len(args))
+	}
+	task.ID = uuid.New().String()
+	task.Status = TaskStatusWaiting
+	task.OperationTime = s.operationTime(task.Operation)
+	t := &taskNode{task: task, exprID: exprID}
+	for slot, arg := range args {
+		if arg.node != nil {
+			arg.node.parent = t
+			arg.node.slot = slot
+			t.waiting++
+		} else {
+			t.setArg(slot, arg.value, arg.text)
+		}
+	}
+	*nodes = append(*nodes, t)
+	return operand{node: t}, nil
+}
+
+// operationTime возвращает настроенное время выполнения операции в миллисекундах.
+func (s *Scheduler) operationTime(op string) int {
+	switch op {
+	case models.OpAdd:
+		return s.cfg.TimeAdditionMS
+	case models.OpSubtract:
+		return s.cfg.TimeSubtractionMS
+	case models.OpMultiply:
+		return s.cfg.TimeMultiplicationsMS
+	case models.OpDivide, models.OpModulo, models.OpFloorDivide:
+		return s.cfg.TimeDivisionsMS
+	case models.OpPower:
+		return s.cfg.TimePowerMS
+	default:
+		return s.cfg.TimeFunctionsMS
+	}
+}
+
+// NextTask выдаёт агенту agentID первую готовую к вычислению задачу вместе с
+// арендой: результат будет принят только с тем же идентификатором аренды и до
+// её окончания. Перед выдачей в очередь возвращаются задачи с просроченной
+// арендой. Пустой agentID — агент, не прошедший регистрацию.
+func (s *Scheduler) NextTask(agentID string) (models.Task, bool) {
+	tasks := s.NextTasks(agentID, 1)
+	if len(tasks) == 0 {
+		return models.Task{}, false
+	}
+	return tasks[0], true
+}
+
+// NextTasks выдаёт агенту agentID до limit готовых задач сразу, каждую со
+// своей арендой, как NextTask. Пустой результат — готовых задач нет.
+func (s *Scheduler) NextTasks(agentID string, limit int) []models.Task {
+	s.mu.Lock()
+	now := s.now()
+	s.requeueExpired(now)
+	count := min(limit, len(s.ready))
+	tasks := make([]models.Task, 0, count)
+	var started []string
+	for _, n := range s.ready[:count] {
+		n.task.Status = TaskStatusInProgress
+		n.task.Attempts++
+		n.task.LeaseID = uuid.New().String()
+		n.task.LeaseExpiresAt = now.Add(s.leaseDuration(n.task))
+		n.task.AgentID = agentID
+		s.leases[n.task.ID] = n
+		s.save(n)
+		tasks = append(tasks, n.task)
+		if !slices.Contains(started, n.exprID) {
+			started = append(started, n.exprID)
+		}
+	}
+	s.ready = s.ready[count:]
+	s.mu.Unlock()
+
+	if s.onStart != nil {
+		for _, exprID := range started {
+			s.onStart(exprID, now)
+		}
+	}
+	return tasks
+}
+
+// leaseDuration — срок аренды задачи: время самой операции плюс запас на сеть
+// и планирование агента.
+func (s *Scheduler) leaseDuration(task models.Task) time.Duration {
+	return time.Duration(task.OperationTime+s.cfg.TaskLeaseTimeoutMS) * time.Millisecond
+}
+
+// requeueExpired возвращает в начало очереди задачи, аренда которых истекла:
+// агент, скорее всего, упал, и задачу должен получить кто-то другой.
+// Вызывается под s.mu.
+func (s *Scheduler) requeueExpired(now time.Time) {
+	var expired []*taskNode
+	for _, n := range s.leases {
+		if now.After(n.task.LeaseExpiresAt) {
+			expired = append(expired, n)
+		}
+	}
+	for id, n := range s.cancelled {
+		if now.After(n.task.LeaseExpiresAt) {
+			delete(s.cancelled, id)
+		}
+	}
+	s.requeue(expired)
+}
+
+// ReleaseAgent возвращает в очередь все задачи, выданные агенту agentID, не
+// дожидаясь окончания их аренды, и возвращает их число. Вызывается, когда
+// агент перестал присылать heartbeat.
+func (s *Scheduler) ReleaseAgent(agentID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var leased []*taskNode
+	for _, n := range s.leases {
+		if n.task.AgentID == agentID {
+			leased = append(leased, n)
+		}
+	}
+	s.requeue(leased)
+	return len(leased)
+}
+
+// requeue снимает аренду с выданных задач и ставит их в начало очереди.
+// Вызывается под s.mu.
+func (s *Scheduler) requeue(leased []*taskNode) {
+	if len(leased) == 0 {
+		return
+	}
+	// Раньше выданные задачи выдаются повторно первыми.
+	sort.Slice(leased, func(i, j int) bool {
+		return leased[i].task.LeaseExpiresAt.Before(leased[j].task.LeaseExpiresAt)
+	})
+	for _, n := range leased {
+		s.release(n)
+		n.task.Status = TaskStatusReady
+		s.save(n)
+	}
+	s.ready = append(leased, s.ready...)
+	s.signal()
+}
+
+// signal будит агентов, ждущих задачу. Вызывается под s.mu.
+func (s *Scheduler) signal() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// Wakeup возвращает канал, который закроется, когда в очереди появятся
+// задачи, и время окончания ближайшей аренды (нулевое, если аренд нет) —
+// тогда задача тоже может вернуться в очередь. Канал нужно получить до
+// NextTask, чтобы не пропустить задачу, поставленную между ними.
+func (s *Scheduler) Wakeup() (<-chan struct{}, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expiry time.Time
+	for _, n := range s.leases {
+		if expiry.IsZero() || n.task.LeaseExpiresAt.Before(expiry) {
+			expiry = n.task.LeaseExpiresAt
+		}
+	}
+	return s.wake, expiry
+}
+
+// release снимает с задачи аренду. Вызывается под s.mu.
+func (s *Scheduler) release(n *taskNode) {
+	delete(s.leases, n.task.ID)
+	n.task.LeaseID = ""
+	n.task.LeaseExpiresAt = time.Time{}
+	n.task.AgentID = ""
+}
+
+// leased находит выданную агенту задачу и проверяет аренду. Результат по
+// просроченной аренде не принимается, а задача сразу возвращается в очередь.
+// Вызывается под s.mu.
+func (s *Scheduler) leased(id, leaseID string) (*taskNode, error) {
+	n, ok := s.nodes[id]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	if n.task.Status != TaskStatusInProgress {
+		return nil, ErrTaskNotInProgress
+	}
+	if n.task.LeaseID != leaseID {
+		return nil, ErrLeaseMismatch
+	}
+	if now := s.now(); now.After(n.task.LeaseExpiresAt) {
+		s.requeueExpired(now)
+		return nil, ErrLeaseExpired
+	}
+	return n, nil
+}
+
+// Tasks возвращает снимок всех задач графа, включая число попыток их выдачи.
+func (s *Scheduler) Tasks() []models.Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tasks := make([]models.Task, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		tasks = append(tasks, n.task)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+	return tasks
+}
+
+// CompleteTask принимает результат задачи от агента и подставляет его в
+// зависимую задачу. Когда вычислена корневая задача, выражение завершается.
+// Задачи точных режимов возвращают результат строкой в value.
+func (s *Scheduler) CompleteTask(id, leaseID string, result float64, value string) error {
+	s.mu.Lock()
+	if s.discard(id, leaseID) {
+		s.mu.Unlock()
+		return nil
+	}
+	n, err := s.leased(id, leaseID)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if err := checkResult(n.task.Mode, value); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	delete(s.nodes, id)
+	delete(s.leases, id)
+
+	parent := n.parent
+	var parentRecord *models.TaskRecord
+	if parent != nil {
+		parent.setArg(n.slot, result, value)
+		parent.waiting--
+		if parent.waiting == 0 {
+			parent.task.Status = TaskStatusReady
+			s.ready = append(s.ready, parent)
+			s.signal()
+		}
+		parentRecord = parent.record()
+	}
+	if err := s.tasks.Complete(id, parentRecord); err != nil {
+		s.log.Error("Failed to save result of task " + id + ": " + err.Error())
+	}
+	s.mu.Unlock()
+
+	if parent == nil && s.onComplete != nil {
+		s.onComplete(n.exprID, result, value)
+	}
+	return nil
+}
+
+// FailTask принимает отказ агента вычислить задачу. Выражение целиком
+// считается ошибочным, поэтому все его оставшиеся задачи снимаются с очереди.
+func (s *Scheduler) FailTask(id, leaseID string, taskErr models.TaskError) error {
+	s.mu.Lock()
+	if s.discard(id, leaseID) {
+		s.mu.Unlock()
+		return nil
+	}
+	n, err := s.leased(id, leaseID)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.dropExpression(n.exprID)
+	s.mu.Unlock()
+
+	if s.onFail != nil {
+		s.onFail(n.exprID, taskErr)
+	}
+	return nil
+}
+
+// CancelExpression снимает с очереди все задачи выражения. Результаты уже
+// выданных агентам задач будут приняты и отброшены. Возвращает false, если
+// задач у выражения нет: оно ещё не разложено на задачи или уже вычислено.
+func (s *Scheduler) CancelExpression(exprID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := false
+	for id, n := range s.nodes {
+		if n.exprID != exprID {
+			continue
+		}
+		found = true
+		if _, ok := s.leases[id]; ok {
+			s.cancelled[id] = n
+		}
+	}
+	if found {
+		s.dropExpression(exprID)
+	}
+	return found
+}
+
+// discard принимает запоздавший результат задачи отменённого выражения, не
+// применяя его. Вызывается под s.mu.
+func (s *Scheduler) discard(id, leaseID string) bool {
+	n, ok := s.cancelled[id]
+	if !ok || n.task.LeaseID != leaseID {
+		return false
+	}
+	delete(s.cancelled, id)
+	return true
+}
+
+// dropExpression удаляет все задачи выражения из графа и очереди. Вызывается под s.mu.
+func (s *Scheduler) dropExpression(exprID string) {
+	for id, n := range s.nodes {
+		if n.exprID == exprID {
+			delete(s.nodes, id)
+			delete(s.leases, id)
+		}
+	}
+	ready := s.ready[:0]
+	for _, n := range s.ready {
+		if n.exprID != exprID {
+			ready = append(ready, n)
+		}
+	}
+	s.ready = ready
+	if err := s.tasks.DeleteByExpression(exprID); err != nil {
+		s.log.Error("Failed to delete tasks of expression " + exprID + ": " + err.Error())
+	}
+}
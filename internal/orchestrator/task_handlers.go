@@ -0,0 +1,266 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dimakirio/calculatorv1/internal/models"
+)
+
+// HandleInternalTask обслуживает протокол обмена задачами с агентами:
+//
+//	GET  /internal/task?agent_id=&wait_ms= — 200 и задача с арендой, либо 204,
+//	                      если работы нет: с wait_ms оркестратор до wait_ms
+//	                      миллисекунд ждёт, пока задача появится (длинный опрос);
+//	POST /internal/task — приём результата {"id", "lease_id", "result"},
+//	                      результата точного режима {"id", "lease_id", "value"}
+//	                      или отказа {"id", "lease_id", "error": {"code", "message"}}.
+//
+// Результат по чужой или просроченной аренде отклоняется с 409: задача к этому
+// времени уже могла быть выдана другому агенту. Результат задачи отменённого
+// выражения принимается и отбрасывается.
+func (o *Orchestrator) HandleInternalTask(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		o.handleGetTask(w, r)
+	case http.MethodPost:
+		o.handlePostTaskResult(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (o *Orchestrator) handleGetTask(w http.ResponseWriter, r *http.Request) {
+	wait, err := o.parseWait(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tasks := o.leaseTasks(r, 1, wait)
+	if len(tasks) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tasks[0])
+}
+
+func (o *Orchestrator) handlePostTaskResult(w http.ResponseWriter, r *http.Request) {
+	var req models.TaskResult
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, "Invalid request body")
+		return
+	}
+
+	ack := o.submitResult(req)
+	if ack.Status != http.StatusOK {
+		writeJSONError(w, ack.Status, ack.Error)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleInternalTaskBatch — пакетный вариант протокола для агентов с большим
+// числом воркеров:
+//
+//	GET  /internal/task/batch?agent_id=&max=&wait_ms= — 200 и {"tasks": [...]}
+//	                      с не более чем max задачами, либо 204; wait_ms — как
+//	                      у одиночного запроса, ожидание заканчивается на первой
+//	                      появившейся задаче;
+//	POST /internal/task/batch — {"results": [...]} из результатов в формате
+//	                      POST /internal/task; ответ 200 и {"results": [{"id",
+//	                      "status", "error"}]} — судьба каждого результата в том
+//	                      же порядке, status — код, с которым одиночный запрос
+//	                      принял бы или отклонил результат.
+//
+// Размер пакета ограничен TASK_BATCH_MAX: задач выдаётся не больше, а
+// результаты сверх него отклоняются с 413. Агент узнаёт ограничение при
+// регистрации.
+func (o *Orchestrator) HandleInternalTaskBatch(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		o.handleGetTaskBatch(w, r)
+	case http.MethodPost:
+		o.handlePostResultBatch(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (o *Orchestrator) handleGetTaskBatch(w http.ResponseWriter, r *http.Request) {
+	wait, err := o.parseWait(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit := 1
+	if v := r.URL.Query().Get("max"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			writeJSONError(w, http.StatusBadRequest, "max must be a positive integer")
+			return
+		}
+	}
+
+	tasks := o.leaseTasks(r, min(limit, o.cfg.TaskBatchMax), wait)
+	if len(tasks) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]models.Task{"tasks": tasks})
+}
+
+func (o *Orchestrator) handlePostResultBatch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Results []models.TaskResult `json:"results"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, "Invalid request body")
+		return
+	}
+	if len(req.Results) == 0 {
+		writeJSONError(w, http.StatusUnprocessableEntity, "At least one result required")
+		return
+	}
+
+	// Результаты сверх TASK_BATCH_MAX не применяются, но отклоняются каждый
+	// отдельно: принятые из того же пакета не теряются.
+	acks := make([]models.TaskAck, len(req.Results))
+	for i, result := range req.Results {
+		if i >= o.cfg.TaskBatchMax {
+			acks[i] = models.TaskAck{ID: result.ID, Status: http.StatusRequestEntityTooLarge, Error: "Batch limit of " + strconv.Itoa(o.cfg.TaskBatchMax) + " results exceeded"}
+			continue
+		}
+		acks[i] = o.submitResult(result)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]models.TaskAck{"results": acks})
+}
+
+// parseWait разбирает wait_ms — сколько ждать задачу в длинном опросе, не
+// дольше TASK_LONG_POLL_MAX_MS.
+func (o *Orchestrator) parseWait(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("wait_ms")
+	if v == "" {
+		return 0, nil
+	}
+	ms, err := strconv.Atoi(v)
+	if err != nil || ms < 0 {
+		return 0, errors.New("wait_ms must be a non-negative integer")
+	}
+	return time.Duration(min(ms, o.cfg.TaskLongPollMaxMS)) * time.Millisecond, nil
+}
+
+// leaseTasks выдаёт агенту из запроса до limit задач. Если задач нет, ждёт до
+// wait, пока они появятся.
+func (o *Orchestrator) leaseTasks(r *http.Request, limit int, wait time.Duration) []models.Task {
+	agentID := r.URL.Query().Get("agent_id")
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		o.reapAgents()
+		wake, expiry := o.scheduler.Wakeup()
+		if tasks := o.scheduler.NextTasks(agentID, limit); len(tasks) > 0 {
+			return tasks
+		}
+		if wait == 0 || !waitForTask(r, wake, expiry, timeout.C) {
+			return nil
+		}
+	}
+}
+
+// submitResult проверяет и применяет один результат задачи.
+func (o *Orchestrator) submitResult(req models.TaskResult) models.TaskAck {
+	ack := models.TaskAck{ID: req.ID, Status: http.StatusOK}
+	reject := func(status int, message string) models.TaskAck {
+		ack.Status, ack.Error = status, message
+		return ack
+	}
+
+	if req.ID == "" || req.LeaseID == "" {
+		return reject(http.StatusUnprocessableEntity, "Task id and lease_id required")
+	}
+	given := 0
+	for _, set := range []bool{req.Result != nil, req.Value != "", req.Error != nil} {
+		if set {
+			given++
+		}
+	}
+	if given != 1 {
+		return reject(http.StatusUnprocessableEntity, "Exactly one of result, value and error required")
+	}
+
+	if req.Error != nil && req.Error.Code == "" {
+		return reject(http.StatusUnprocessableEntity, "Error code required")
+	}
+
+	var err error
+	switch {
+	case req.Error != nil:
+		err = o.scheduler.FailTask(req.ID, req.LeaseID, *req.Error)
+	case req.Value != "":
+		err = o.scheduler.CompleteTask(req.ID, req.LeaseID, 0, req.Value)
+	default:
+		err = o.scheduler.CompleteTask(req.ID, req.LeaseID, *req.Result, "")
+	}
+	switch {
+	case errors.Is(err, ErrTaskNotFound):
+		return reject(http.StatusNotFound, "Task not found")
+	case errors.Is(err, ErrInvalidResult):
+		return reject(http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, ErrTaskNotInProgress), errors.Is(err, ErrLeaseMismatch), errors.Is(err, ErrLeaseExpired):
+		return reject(http.StatusConflict, err.Error())
+	case err != nil:
+		o.log.Error("Failed to complete task " + req.ID + ": " + err.Error())
+		return reject(http.StatusInternalServerError, "Failed to complete task")
+	}
+	return ack
+}
+
+// waitForTask ждёт, пока в очереди может появиться задача: её поставили в
+// очередь или истекла ближайшая аренда. Возвращает false, если длинный опрос
+// закончился или агент закрыл соединение.
+func waitForTask(r *http.Request, wake <-chan struct{}, expiry time.Time, timeout <-chan time.Time) bool {
+	var expired <-chan time.Time
+	if !expiry.IsZero() {
+		t := time.NewTimer(time.Until(expiry) + time.Millisecond)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-wake:
+		return true
+	case <-expired:
+		return true
+	case <-timeout:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// HandleGetTasks отдаёт администратору все незавершённые задачи с числом
+// попыток их выдачи, чтобы по повторным выдачам можно было найти падающих
+// агентов. В задачах есть операнды выражений всех пользователей и аренды, с
+// которыми принимается результат, поэтому остальным список недоступен.
+func (o *Orchestrator) HandleGetTasks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if !o.requireAdmin(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]models.Task{"tasks": o.scheduler.Tasks()})
+}
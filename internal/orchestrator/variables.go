@@ -0,0 +1,80 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// bindVariables подставляет значения переменных запроса в AST. Каждая
+// переменная выражения должна быть задана, а каждая заданная — использована:
+// лишняя переменная почти всегда означает опечатку в имени.
+func bindVariables(root node, variables map[string]json.Number) (node, error) {
+	used := make(map[string]bool)
+	bound, err := bindNode(root, variables, used)
+	if err != nil {
+		return nil, err
+	}
+
+	var unused []string
+	for name := range variables {
+		if !used[name] {
+			unused = append(unused, fmt.Sprintf("%q", name))
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		return nil, fmt.Errorf("unused variables: %s", strings.Join(unused, ", "))
+	}
+	return bound, nil
+}
+
+func bindNode(n node, variables map[string]json.Number, used map[string]bool) (node, error) {
+	switch n := n.(type) {
+	case *variableNode:
+		value, ok := variables[n.name]
+		if !ok {
+			return nil, &SyntaxError{
+				Offset:  n.pos,
+				Token:   n.name,
+				Message: fmt.Sprintf("unbound variable %q at offset %d", n.name, n.pos),
+			}
+		}
+		used[n.name] = true
+		f, err := value.Float64()
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return nil, fmt.Errorf("invalid value of variable %q: %s", n.name, value)
+		}
+		return &numberNode{value: f, text: value.String(), pos: n.pos}, nil
+	case *unaryNode:
+		operand, err := bindNode(n.operand, variables, used)
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: n.op, operand: operand, pos: n.pos}, nil
+	case *binaryNode:
+		left, err := bindNode(n.left, variables, used)
+		if err != nil {
+			return nil, err
+		}
+		right, err := bindNode(n.right, variables, used)
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{op: n.op, left: left, right: right, pos: n.pos}, nil
+	case *callNode:
+		call := &callNode{name: n.name, args: make([]node, len(n.args)), pos: n.pos}
+		for i, arg := range n.args {
+			bound, err := bindNode(arg, variables, used)
+			if err != nil {
+				return nil, err
+			}
+			call.args[i] = bound
+		}
+		return call, nil
+	}
+	return n, nil
+}
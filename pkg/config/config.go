@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
@@ -10,6 +11,54 @@ type Config struct {
 	LogLevel   string
 	JWTSecret  string
 	DBPath     string
+
+	// Настройки подключения к SQLite: пул соединений, журнал WAL (читатели не
+	// блокируют писателя) и сколько ждать освобождения блокировки базы.
+	DBMaxOpenConns      int
+	DBMaxIdleConns      int
+	DBConnMaxLifetimeMS int
+	DBWAL               bool
+	DBBusyTimeoutMS     int
+
+	// Настройки агента: адрес оркестратора, число воркеров, сколько
+	// оркестратор держит запрос задачи в ожидании работы (0 — отвечает сразу),
+	// минимальная пауза между пустыми опросами очереди и таймаут остальных
+	// запросов к оркестратору.
+	OrchestratorURL       string
+	ComputingPower        int
+	AgentBatchSize        int // сколько задач агент берёт и сдаёт за один запрос; 1 — каждый воркер по одной
+	AgentLongPollMS       int
+	AgentPollIntervalMS   int
+	AgentRequestTimeoutMS int
+
+	// Наибольшее время, на которое оркестратор задерживает запрос задачи, и
+	// наибольший размер пакета задач или результатов.
+	TaskLongPollMaxMS int
+	TaskBatchMax      int
+
+	// Время выполнения операций агентом в миллисекундах; позволяет имитировать
+	// дорогие вычисления. % и // считаются делением.
+	TimeAdditionMS        int
+	TimeSubtractionMS     int
+	TimeMultiplicationsMS int
+	TimeDivisionsMS       int
+	TimePowerMS           int
+	TimeFunctionsMS       int
+
+	// Запас времени сверх времени операции, за который агент должен вернуть
+	// результат; по истечении аренды задача выдаётся повторно.
+	TaskLeaseTimeoutMS int
+
+	// Агент отправляет оркестратору heartbeat раз в AgentHeartbeatIntervalMS;
+	// пропустивший AgentMissedHeartbeats подряд агент считается упавшим, и
+	// выданные ему задачи возвращаются в очередь.
+	AgentHeartbeatIntervalMS int
+	AgentMissedHeartbeats    int
+	// Сколько упавший агент остаётся в списке агентов, прежде чем будет забыт.
+	AgentDeadRetentionMS int
+
+	// Логины пользователей, которым доступны административные маршруты.
+	AdminLogins []string
 }
 
 func LoadConfig() *Config {
@@ -38,6 +87,36 @@ func LoadConfig() *Config {
 		LogLevel:   logLevel,
 		JWTSecret:  jwtSecret,
 		DBPath:     dbPath,
+
+		DBMaxOpenConns:      getEnvAsInt("DB_MAX_OPEN_CONNS", 10),
+		DBMaxIdleConns:      getEnvAsInt("DB_MAX_IDLE_CONNS", 5),
+		DBConnMaxLifetimeMS: getEnvAsInt("DB_CONN_MAX_LIFETIME_MS", 0),
+		DBWAL:               getEnvAsBool("DB_WAL", true),
+		DBBusyTimeoutMS:     getEnvAsInt("DB_BUSY_TIMEOUT_MS", 5000),
+
+		OrchestratorURL:       strings.TrimRight(getEnv("ORCHESTRATOR_URL", "http://localhost:8080"), "/"),
+		ComputingPower:        getEnvAsInt("COMPUTING_POWER", 1),
+		AgentBatchSize:        getEnvAsInt("AGENT_BATCH_SIZE", 1),
+		AgentLongPollMS:       getEnvAsInt("AGENT_LONG_POLL_MS", 30000),
+		AgentPollIntervalMS:   getEnvAsInt("AGENT_POLL_INTERVAL_MS", 1000),
+		AgentRequestTimeoutMS: getEnvAsInt("AGENT_REQUEST_TIMEOUT_MS", 10000),
+
+		TimeAdditionMS:        getEnvAsInt("TIME_ADDITION_MS", 0),
+		TimeSubtractionMS:     getEnvAsInt("TIME_SUBTRACTION_MS", 0),
+		TimeMultiplicationsMS: getEnvAsInt("TIME_MULTIPLICATIONS_MS", 0),
+		TimeDivisionsMS:       getEnvAsInt("TIME_DIVISIONS_MS", 0),
+		TimePowerMS:           getEnvAsInt("TIME_POWER_MS", 0),
+		TimeFunctionsMS:       getEnvAsInt("TIME_FUNCTIONS_MS", 0),
+
+		TaskLeaseTimeoutMS: getEnvAsInt("TASK_LEASE_TIMEOUT_MS", 30000),
+		TaskLongPollMaxMS:  getEnvAsInt("TASK_LONG_POLL_MAX_MS", 60000),
+		TaskBatchMax:       getEnvAsInt("TASK_BATCH_MAX", 100),
+
+		AgentHeartbeatIntervalMS: getEnvAsInt("AGENT_HEARTBEAT_INTERVAL_MS", 5000),
+		AgentMissedHeartbeats:    getEnvAsInt("AGENT_MISSED_HEARTBEATS", 3),
+		AgentDeadRetentionMS:     getEnvAsInt("AGENT_DEAD_RETENTION_MS", 3600000),
+
+		AdminLogins: getEnvAsList("ADMIN_LOGINS", nil),
 	}
 }
 
@@ -56,3 +135,27 @@ func getEnvAsInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+// getEnvAsList разбирает список значений через запятую; пустые элементы пропускаются.
+func getEnvAsList(key string, defaultValue []string) []string {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getEnvAsBool(key string, defaultValue bool) bool {
+	if value, exists := os.LookupEnv(key); exists {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}